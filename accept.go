@@ -0,0 +1,87 @@
+package handler
+
+import (
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// AddAccept is like Add, but the route only matches requests that accept
+// mediaType, e.g. "application/json", according to their Accept header.
+// Requests without an Accept header accept any media type.
+//
+// If several routes added through AddAccept match a request in a row, the
+// one whose media type the request prefers, by q-value, wins. Ties are broken
+// by registration order.
+func (h *RegexpHandler) AddAccept(mediaType, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.accept = mediaType
+  return h.addRoute(rt)
+}
+
+// negotiate returns the route among rt and the routes following it that
+// matches a request and whose media type the request prefers. The search
+// stops at the first matching route that isn't restricted to a media type.
+func (h *RegexpHandler) negotiate(rt *Route, submatches []string, routes []*Route, r *http.Request, path, method string) (*Route, []string) {
+  accept := r.Header.Get("Accept")
+  best := acceptQuality(accept, rt.accept)
+  for _, next := range routes {
+    matches, ok := next.submatches(path)
+    if !ok || !next.matchesRequest(r) || !next.matchesMethod(method) {
+      continue
+    }
+    if next.accept == "" {
+      break
+    }
+    if q := acceptQuality(accept, next.accept); q > best {
+      rt, submatches, best = next, matches, q
+    }
+  }
+  return rt, submatches
+}
+
+// acceptQuality returns the q-value an Accept header assigns to a media type,
+// taken from the most specific media range that matches it. An empty header
+// accepts everything with a q-value of 1.
+func acceptQuality(accept, mediaType string) float64 {
+  if accept == "" {
+    return 1
+  }
+  mediaType = strings.ToLower(mediaType)
+  slash := strings.Index(mediaType, "/")
+  if slash < 0 {
+    return 0
+  }
+  q, specificity := 0.0, 0
+  for _, mediaRange := range strings.Split(accept, ",") {
+    params := strings.Split(mediaRange, ";")
+    name := strings.ToLower(strings.TrimSpace(params[0]))
+    var s int
+    switch {
+    case name == mediaType:
+      s = 3
+    case name == mediaType[:slash]+"/*":
+      s = 2
+    case name == "*/*":
+      s = 1
+    default:
+      continue
+    }
+    if s <= specificity {
+      continue
+    }
+    specificity, q = s, 1
+    for _, param := range params[1:] {
+      key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+      if strings.EqualFold(key, "q") {
+        if v, err := strconv.ParseFloat(value, 64); err == nil {
+          q = v
+        }
+      }
+    }
+  }
+  return q
+}
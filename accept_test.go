@@ -0,0 +1,45 @@
+package handler
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestAddAccept(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddAccept("application/json", "/users", write("json"))
+  h.AddAccept("text/html", "/users", write("html"))
+  for accept, want := range map[string]string{
+    "":                                  "json",
+    "application/json":                  "json",
+    "text/html":                         "html",
+    "text/*":                            "html",
+    "*/*":                               "json",
+    "application/json;q=0.5, text/html": "html",
+    "text/html;q=0.1, */*;q=0.9":        "json",
+  } {
+    r := httptest.NewRequest("GET", "/users", nil)
+    if accept != "" {
+      r.Header.Set("Accept", accept)
+    }
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, r)
+    if body := rec.Body.String(); body != want {
+      t.Errorf("Accept %q: got %q, want %q", accept, body, want)
+    }
+  }
+}
+
+func TestAddAcceptFallback(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddAccept("application/json", "/users", write("json"))
+  h.Add("/users", write("fallback"))
+  r := httptest.NewRequest("GET", "/users", nil)
+  r.Header.Set("Accept", "image/png")
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if rec.Code != http.StatusOK || rec.Body.String() != "fallback" {
+    t.Errorf("got %d %q, want the media-agnostic route", rec.Code, rec.Body.String())
+  }
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+  "context"
+  "net/http"
+  "strconv"
+)
+
+type authUserKey struct{}
+
+// BasicAuth returns a middleware, for use with Use or a route's Use, that
+// requires requests to carry HTTP basic authentication credentials accepted
+// by check. Requests without credentials, or whose credentials check
+// rejects, are answered with 401 Unauthorized and a WWW-Authenticate header
+// naming realm. The user name of accepted requests is stored in the
+// request's context, see AuthUser. To avoid leaking information through
+// timing, check should compare credentials in constant time, e.g. with
+// crypto/subtle's ConstantTimeCompare.
+func BasicAuth(realm string, check func(user, password string) bool) func(http.Handler) http.Handler {
+  challenge := "Basic realm=" + strconv.Quote(realm)
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      user, password, ok := r.BasicAuth()
+      if !ok || !check(user, password) {
+        w.Header().Set("WWW-Authenticate", challenge)
+        http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+        return
+      }
+      next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)))
+    })
+  }
+}
+
+// AuthUser returns the user name BasicAuth authenticated the request with,
+// or "" if it wasn't authenticated.
+func AuthUser(r *http.Request) string {
+  user, _ := r.Context().Value(authUserKey{}).(string)
+  return user
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+  "crypto/subtle"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Use(BasicAuth("admin area", func(user, password string) bool {
+    return subtle.ConstantTimeCompare([]byte(user+":"+password), []byte("alice:secret")) == 1
+  }))
+  called := false
+  var user string
+  h.Add("/admin", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called, user = true, AuthUser(r)
+  })
+  for _, test := range []struct {
+    name           string
+    user, password string
+    auth           bool
+    want           int
+  }{
+    {"missing credentials", "", "", false, http.StatusUnauthorized},
+    {"wrong password", "alice", "guess", true, http.StatusUnauthorized},
+    {"wrong user", "bob", "secret", true, http.StatusUnauthorized},
+    {"valid credentials", "alice", "secret", true, http.StatusOK},
+  } {
+    called, user = false, ""
+    r := httptest.NewRequest("GET", "/admin", nil)
+    if test.auth {
+      r.SetBasicAuth(test.user, test.password)
+    }
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, r)
+    if rec.Code != test.want {
+      t.Errorf("%s: got %d, want %d", test.name, rec.Code, test.want)
+    }
+    if test.want == http.StatusUnauthorized {
+      if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="admin area"` || called {
+        t.Errorf("%s: got WWW-Authenticate %q, called %v", test.name, got, called)
+      }
+    } else if !called || user != "alice" {
+      t.Errorf("%s: called %v with user %q, want alice", test.name, called, user)
+    }
+  }
+  if user := AuthUser(httptest.NewRequest("GET", "/", nil)); user != "" {
+    t.Errorf("got user %q for an unauthenticated request", user)
+  }
+}
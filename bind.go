@@ -0,0 +1,139 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "reflect"
+  "strconv"
+)
+
+// AddBind is like AddNamed, but the function receives the submatches of named
+// groups stored in the fields of a struct. Fields are bound to the group
+// named by their `route` tag, e.g.
+//
+//   type user struct {
+//     ID   int    `route:"id"`
+//     Name string `route:"name"`
+//   }
+//   h.AddBind("/users/(?P<id>\\d+)/(?P<name>[^/]+)", user{}, f)
+//
+// target is a struct or a pointer to one; for each request, the function
+// receives a new value of the same type with the bound fields set. Fields
+// may be strings, bools, integers or floats, converted with the strconv
+// package. If a submatch can't be converted, including an empty one for a
+// field that isn't a string, the request is answered with 400 Bad Request
+// and the function is not called. AddBind panics if target isn't a struct,
+// or a tag names a group the expression doesn't have or a field of an
+// unsupported type.
+func (h *RegexpHandler) AddBind(expression string, target interface{}, function func(w http.ResponseWriter, r *http.Request, bound interface{})) *Route {
+  rt, err := h.newRoute(expression, nil)
+  if err != nil {
+    panic(err)
+  }
+  typ := reflect.TypeOf(target)
+  pointer := typ != nil && typ.Kind() == reflect.Ptr
+  if pointer {
+    typ = typ.Elem()
+  }
+  if typ == nil || typ.Kind() != reflect.Struct {
+    panic(fmt.Errorf("handler: bind target %T is not a struct", target))
+  }
+  fields, err := bindFields(typ, rt.re.SubexpNames()[1:])
+  if err != nil {
+    panic(err)
+  }
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    v := reflect.New(typ).Elem()
+    for _, f := range fields {
+      if err := setField(v.Field(f.field), m[f.group]); err != nil {
+        http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+        return
+      }
+    }
+    if pointer {
+      function(w, r, v.Addr().Interface())
+    } else {
+      function(w, r, v.Interface())
+    }
+  }
+  return h.addRoute(rt)
+}
+
+// boundField maps a struct field to the index of a submatch.
+type boundField struct {
+  field int
+  group int
+}
+
+// bindFields returns the fields of typ bound to the groups with the given
+// names.
+func bindFields(typ reflect.Type, names []string) ([]boundField, error) {
+  var fields []boundField
+  for i := 0; i < typ.NumField(); i++ {
+    field := typ.Field(i)
+    name, ok := field.Tag.Lookup("route")
+    if !ok {
+      continue
+    }
+    group := -1
+    for j, n := range names {
+      if n == name {
+        group = j
+        break
+      }
+    }
+    if group < 0 {
+      return nil, fmt.Errorf("handler: field %s is bound to unknown group %q", field.Name, name)
+    }
+    if field.PkgPath != "" || !bindable(field.Type.Kind()) {
+      return nil, fmt.Errorf("handler: field %s of type %s cannot be bound", field.Name, field.Type)
+    }
+    fields = append(fields, boundField{field: i, group: group})
+  }
+  return fields, nil
+}
+
+// bindable reports whether fields of the given kind can be bound.
+func bindable(kind reflect.Kind) bool {
+  switch kind {
+  case reflect.String, reflect.Bool,
+    reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+    reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+    reflect.Float32, reflect.Float64:
+    return true
+  }
+  return false
+}
+
+// setField sets a bindable field to the value s converts to.
+func setField(v reflect.Value, s string) error {
+  switch v.Kind() {
+  case reflect.String:
+    v.SetString(s)
+  case reflect.Bool:
+    b, err := strconv.ParseBool(s)
+    if err != nil {
+      return err
+    }
+    v.SetBool(b)
+  case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+    n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetInt(n)
+  case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+    n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetUint(n)
+  case reflect.Float32, reflect.Float64:
+    f, err := strconv.ParseFloat(s, v.Type().Bits())
+    if err != nil {
+      return err
+    }
+    v.SetFloat(f)
+  }
+  return nil
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+  "net/http"
+  "testing"
+)
+
+type boundUser struct {
+  ID     int    `route:"id"`
+  Name   string `route:"name"`
+  Admin  bool   `route:"admin"`
+  Ignore string
+}
+
+func TestAddBind(t *testing.T) {
+  h := NewRegexpHandler()
+  var got interface{}
+  h.AddBind("/users/(?P<id>-?\\d+)/(?P<name>[^/]*)/(?P<admin>\\w+)", boundUser{}, func(w http.ResponseWriter, r *http.Request, bound interface{}) {
+    got = bound
+  })
+  serve(h, "GET", "/users/42/bob/true")
+  if u, ok := got.(boundUser); !ok || u != (boundUser{ID: 42, Name: "bob", Admin: true}) {
+    t.Errorf("got %#v, want the bound user", got)
+  }
+  for _, path := range []string{"/users/99999999999999999999/bob/true", "/users/1/bob/maybe"} {
+    got = nil
+    if rec := serve(h, "GET", path); rec.Code != http.StatusBadRequest || got != nil {
+      t.Errorf("%s: got %d, called with %v; want 400", path, rec.Code, got)
+    }
+  }
+}
+
+func TestAddBindPointer(t *testing.T) {
+  h := NewRegexpHandler()
+  var got interface{}
+  h.AddBind("/users/(?P<id>\\d+)/(?P<name>\\w*)/(?P<admin>\\w+)", &boundUser{}, func(w http.ResponseWriter, r *http.Request, bound interface{}) {
+    got = bound
+  })
+  serve(h, "GET", "/users/7//false")
+  if u, ok := got.(*boundUser); !ok || u.ID != 7 {
+    t.Errorf("got %#v, want a *boundUser with ID 7", got)
+  }
+}
+
+func TestAddBindInvalid(t *testing.T) {
+  for name, target := range map[string]interface{}{
+    "not a struct": 42,
+    "missing group": struct {
+      X string `route:"x"`
+    }{},
+    "unsupported type": struct {
+      ID []int `route:"id"`
+    }{},
+  } {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Errorf("%s: AddBind didn't panic", name)
+        }
+      }()
+      NewRegexpHandler().AddBind("/users/(?P<id>\\d+)", target, func(w http.ResponseWriter, r *http.Request, bound interface{}) {})
+    }()
+  }
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "time"
+)
+
+// AddCache is like Add, but caches responses to GET requests for ttl, keyed by
+// the path the expression matched against and the query string. While a
+// response is cached, requests for the same path and query are answered with
+// its status code, header and body without calling the function. Only 200 OK
+// responses are cached, and not if they set cookies or their Cache-Control
+// header contains no-store or private, since those are meant for a single
+// client. Expired entries are evicted lazily.
+func (h *RegexpHandler) AddCache(expression string, ttl time.Duration, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  c := &responseCache{entries: make(map[cacheKey]*cacheEntry)}
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    if r.Method != http.MethodGet {
+      function(w, r, m)
+      return
+    }
+    key := cacheKey{path: matchFromContext(r).path, query: r.URL.RawQuery}
+    if e := c.get(key); e != nil {
+      e.writeTo(w)
+      return
+    }
+    rec := httptest.NewRecorder()
+    function(rec, r, m)
+    e := &cacheEntry{status: rec.Code, header: rec.Header(), body: rec.Body.Bytes(), expires: time.Now().Add(ttl)}
+    if e.cacheable() {
+      c.put(key, e)
+    }
+    e.writeTo(w)
+  })
+}
+
+// responseCache holds the cached responses of a route.
+type responseCache struct {
+  mu      sync.Mutex
+  entries map[cacheKey]*cacheEntry
+}
+
+// cacheKey identifies the cached response to a request.
+type cacheKey struct {
+  path, query string
+}
+
+type cacheEntry struct {
+  status  int
+  header  http.Header
+  body    []byte
+  expires time.Time
+}
+
+// get returns the fresh entry for key, or nil.
+func (c *responseCache) get(key cacheKey) *cacheEntry {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  e := c.entries[key]
+  if e != nil && !time.Now().Before(e.expires) {
+    delete(c.entries, key)
+    return nil
+  }
+  return e
+}
+
+// put stores an entry for key, evicting any expired entries.
+func (c *responseCache) put(key cacheKey, e *cacheEntry) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  now := time.Now()
+  for k, old := range c.entries {
+    if !now.Before(old.expires) {
+      delete(c.entries, k)
+    }
+  }
+  c.entries[key] = e
+}
+
+// cacheable reports whether a response may be cached and served to other
+// requests.
+func (e *cacheEntry) cacheable() bool {
+  if e.status != http.StatusOK || len(e.header.Values("Set-Cookie")) > 0 {
+    return false
+  }
+  for _, directive := range strings.Split(strings.ToLower(strings.Join(e.header.Values("Cache-Control"), ",")), ",") {
+    if directive = strings.TrimSpace(directive); directive == "no-store" || directive == "private" || strings.HasPrefix(directive, "private=") {
+      return false
+    }
+  }
+  return true
+}
+
+// writeTo writes the cached response to w.
+func (e *cacheEntry) writeTo(w http.ResponseWriter) {
+  header := w.Header()
+  for k, v := range e.header {
+    header[k] = append([]string(nil), v...)
+  }
+  w.WriteHeader(e.status)
+  w.Write(e.body)
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+  "net/http"
+  "testing"
+  "time"
+)
+
+func TestAddCache(t *testing.T) {
+  h := NewRegexpHandler()
+  calls := 0
+  h.AddCache("/items/(\\d+)", 50*time.Millisecond, func(w http.ResponseWriter, r *http.Request, m []string) {
+    calls++
+    w.Header().Set("X-Call", string(rune('0'+calls)))
+    w.Write([]byte(m[0] + r.URL.RawQuery))
+  })
+  first := serve(h, "GET", "/items/1")
+  second := serve(h, "GET", "/items/1")
+  if calls != 1 || second.Body.String() != "1" || second.Header().Get("X-Call") != first.Header().Get("X-Call") {
+    t.Errorf("got %d calls and %q, want the second request served from the cache", calls, second.Body.String())
+  }
+  if body := serve(h, "GET", "/items/1?page=2").Body.String(); calls != 2 || body != "1page=2" {
+    t.Errorf("got %d calls and %q, want a different query cached separately", calls, body)
+  }
+  if serve(h, "POST", "/items/1"); calls != 3 {
+    t.Errorf("got %d calls, want POST requests to bypass the cache", calls)
+  }
+  time.Sleep(60 * time.Millisecond)
+  if serve(h, "GET", "/items/1"); calls != 4 {
+    t.Errorf("got %d calls, want an expired entry to call the function again", calls)
+  }
+}
+
+func TestAddCacheSkipsPrivateResponses(t *testing.T) {
+  for name, set := range map[string]func(http.Header){
+    "no-store":   func(h http.Header) { h.Set("Cache-Control", "no-store") },
+    "private":    func(h http.Header) { h.Set("Cache-Control", "max-age=60, private") },
+    "Set-Cookie": func(h http.Header) { h.Set("Set-Cookie", "session=secret") },
+    "error":      func(h http.Header) { h.Set("X-Status", "500") },
+  } {
+    h := NewRegexpHandler()
+    calls := 0
+    h.AddCache("/a", time.Minute, func(w http.ResponseWriter, r *http.Request, m []string) {
+      calls++
+      set(w.Header())
+      if w.Header().Get("X-Status") != "" {
+        w.WriteHeader(http.StatusInternalServerError)
+      }
+    })
+    serve(h, "GET", "/a")
+    serve(h, "GET", "/a")
+    if calls != 2 {
+      t.Errorf("%s: got %d calls, want the response not to be cached", name, calls)
+    }
+  }
+}
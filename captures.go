@@ -0,0 +1,50 @@
+package handler
+
+import "net/http"
+
+// Captures holds the submatches of a route's expression, accessible both by
+// position and by group name.
+type Captures struct {
+  values []string
+  names  []string
+}
+
+// Get returns the i'th submatch, counting from 0 like the submatches passed
+// to functions added through Add. It reports false if there is no such
+// group.
+func (c Captures) Get(i int) (string, bool) {
+  if i < 0 || i >= len(c.values) {
+    return "", false
+  }
+  return c.values[i], true
+}
+
+// Name returns the submatch of the group with the given name. It reports
+// false if the expression has no such group.
+func (c Captures) Name(name string) (string, bool) {
+  for i, n := range c.names {
+    if n != "" && n == name {
+      return c.values[i], true
+    }
+  }
+  return "", false
+}
+
+// Len returns the number of groups.
+func (c Captures) Len() int {
+  return len(c.values)
+}
+
+// AddCaptures is like Add, but the function receives the submatches as
+// Captures, so that groups can be accessed by position or by name.
+func (h *RegexpHandler) AddCaptures(expression string, function func(w http.ResponseWriter, r *http.Request, captures Captures)) *Route {
+  rt, err := h.newRoute(expression, nil)
+  if err != nil {
+    panic(err)
+  }
+  names := rt.re.SubexpNames()[1:]
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    function(w, r, Captures{values: m, names: names})
+  }
+  return h.addRoute(rt)
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+  "net/http"
+  "testing"
+)
+
+func TestAddCaptures(t *testing.T) {
+  h := NewRegexpHandler()
+  var got Captures
+  h.AddCaptures("/users/(?P<id>\\d+)/(\\w+)", func(w http.ResponseWriter, r *http.Request, captures Captures) {
+    got = captures
+  })
+  serve(h, "GET", "/users/42/posts")
+  if got.Len() != 2 {
+    t.Fatalf("got %d captures, want 2", got.Len())
+  }
+  if id, ok := got.Get(0); !ok || id != "42" {
+    t.Errorf("Get(0) = %q, %v; want 42", id, ok)
+  }
+  if id, ok := got.Name("id"); !ok || id != "42" {
+    t.Errorf("Name(\"id\") = %q, %v; want 42", id, ok)
+  }
+  if s, ok := got.Get(1); !ok || s != "posts" {
+    t.Errorf("Get(1) = %q, %v; want posts", s, ok)
+  }
+  for _, name := range []string{"missing", ""} {
+    if s, ok := got.Name(name); ok || s != "" {
+      t.Errorf("Name(%q) = %q, %v; want \"\", false", name, s, ok)
+    }
+  }
+  if s, ok := got.Get(2); ok || s != "" {
+    t.Errorf("Get(2) = %q, %v; want \"\", false", s, ok)
+  }
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+  "regexp"
+  "strings"
+)
+
+// combined is a single regular expression that alternates between the
+// expressions of a set of routes, so that one search finds the first route
+// whose expression matches a path.
+type combined struct {
+  re *regexp.Regexp
+  // groups holds, for each route, the index of the group that wraps its
+  // expression. The route's own groups follow it.
+  groups []int
+  // subexps holds the number of groups in each route's expression.
+  subexps []int
+}
+
+// newCombined combines the expressions of routes into one.
+//
+// Each unanchored route's expression is preceded by a lazy ".*?" so that,
+// like a search with the route's own expression, it matches at the leftmost
+// possible position. Expressions anchored with "^" can only match at the
+// start, so they go without it, which keeps the combined expression much
+// cheaper to run. Alternatives are tried in order, so the first route that
+// matches wins just as it would in a linear scan.
+func newCombined(routes []*Route) (*combined, error) {
+  c := &combined{
+    groups:  make([]int, len(routes)),
+    subexps: make([]int, len(routes)),
+  }
+  var b strings.Builder
+  b.WriteString("^(?:")
+  group := 1
+  for i, rt := range routes {
+    if i > 0 {
+      b.WriteString("|")
+    }
+    if expression := rt.re.String(); strings.HasPrefix(expression, "^") {
+      b.WriteString("((?:" + expression + "))")
+    } else {
+      b.WriteString("((?s:.*?)(?:" + expression + "))")
+    }
+    c.groups[i] = group
+    c.subexps[i] = rt.re.NumSubexp()
+    group += 1 + c.subexps[i]
+  }
+  b.WriteString(")")
+  re, err := regexp.Compile(b.String())
+  if err != nil {
+    return nil, err
+  }
+  c.re = re
+  return c, nil
+}
+
+// match returns the index of the first route whose expression matches path,
+// along with its submatches.
+func (c *combined) match(path string) (int, []string, bool) {
+  loc := c.re.FindStringSubmatchIndex(path)
+  if loc == nil {
+    return 0, nil, false
+  }
+  for i, group := range c.groups {
+    if loc[2*group] < 0 {
+      continue
+    }
+    submatches := make([]string, c.subexps[i])
+    for j := range submatches {
+      if start := loc[2*(group+1+j)]; start >= 0 {
+        submatches[j] = path[start:loc[2*(group+1+j)+1]]
+      }
+    }
+    return i, submatches, true
+  }
+  return 0, nil, false
+}
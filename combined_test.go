@@ -0,0 +1,91 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+// table registers a mix of overlapping routes on h, each writing its index
+// and submatches.
+func table(h *RegexpHandler, n int) {
+  expressions := []string{
+    "/users/(\\d+)",
+    "/users/(\\w+)",
+    "/users/new",
+    "/files/(.*)",
+    "/(a|ab)(c?)",
+    "/opt(/x)?",
+    "/static/[^/]+\\.(css|js)",
+  }
+  for i := 0; i < n; i++ {
+    expression := expressions[i%len(expressions)]
+    if i >= len(expressions) {
+      expression = fmt.Sprintf("/r%d%s", i, expression)
+    }
+    i := i
+    h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+      fmt.Fprint(w, i, m)
+    })
+  }
+}
+
+// paths are requests to dispatch through handlers built by table.
+var paths = []string{
+  "/users/42", "/users/bob", "/users/new", "/users/", "/files/", "/files/a/b",
+  "/ab", "/abc", "/ac", "/opt", "/opt/x", "/opt/y", "/static/a.css",
+  "/static/a.txt", "/r7/users/1", "/r150/files/x", "/r199/opt/x", "/r8/users/x",
+  "/none", "",
+}
+
+func TestCompileDispatchesLikeLinearScan(t *testing.T) {
+  linear, compiled := NewRegexpHandler(), NewRegexpHandler()
+  table(linear, 200)
+  table(compiled, 200)
+  if err := compiled.Compile(); err != nil {
+    t.Fatal(err)
+  }
+  for _, path := range paths {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.URL.Path = path
+    want, got := httptest.NewRecorder(), httptest.NewRecorder()
+    linear.ServeHTTP(want, r)
+    compiled.ServeHTTP(got, r)
+    if got.Body.String() != want.Body.String() {
+      t.Errorf("%q: compiled dispatched to %q, linear to %q", path, got.Body.String(), want.Body.String())
+    }
+  }
+}
+
+func TestCompileDiscardedByAdd(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  if err := h.Compile(); err != nil {
+    t.Fatal(err)
+  }
+  h.Add("/b", write("b"))
+  if body := serve(h, "GET", "/b").Body.String(); body != "b" {
+    t.Errorf("got %q for a route added after Compile", body)
+  }
+}
+
+func benchmarkMatching(b *testing.B, compile bool) {
+  h := NewRegexpHandler()
+  table(h, 200)
+  if compile {
+    if err := h.Compile(); err != nil {
+      b.Fatal(err)
+    }
+  }
+  r := httptest.NewRequest("GET", "/r199/opt/x", nil)
+  w := httptest.NewRecorder()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    h.ServeHTTP(w, r)
+  }
+}
+
+func BenchmarkLinear200(b *testing.B)   { benchmarkMatching(b, false) }
+func BenchmarkCombined200(b *testing.B) { benchmarkMatching(b, true) }
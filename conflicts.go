@@ -0,0 +1,147 @@
+package handler
+
+import (
+  "regexp/syntax"
+)
+
+// maxSamples limits the number of sample paths Conflicts generates for each
+// route.
+const maxSamples = 32
+
+// Conflicts returns pairs of indexes of routes where the earlier route seems
+// to shadow the later one, so that the later one can never serve a request.
+// It is meant for tests of route tables.
+//
+// Conflicts is a heuristic: it generates sample paths from the later route's
+// expression, taking each alternative and both zero and one repetition of
+// optional parts, and reports the first earlier route whose expression
+// matches all of them. An earlier route is only considered if it accepts
+// every method the later one does and isn't restricted to hosts, media types
+// or other conditions. Routes shadowed only for some paths are not reported,
+// and rarely, a route may be reported although paths the samples miss reach
+// it.
+func (h *RegexpHandler) Conflicts() [][2]int {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  var conflicts [][2]int
+  for j, later := range h.routes {
+    parsed, err := syntax.Parse(later.re.String(), syntax.Perl)
+    if err != nil {
+      continue
+    }
+    paths := samples(parsed)
+    if len(paths) == 0 {
+      continue
+    }
+    for i, earlier := range h.routes[:j] {
+      if earlier.restricted() || !coversMethods(earlier.methods, later.methods) {
+        continue
+      }
+      if matchesAll(earlier, paths) {
+        conflicts = append(conflicts, [2]int{i, j})
+        break
+      }
+    }
+  }
+  return conflicts
+}
+
+// restricted reports whether the route rejects some requests whose path and
+// method it matches.
+func (rt *Route) restricted() bool {
+  return rt.host != nil || rt.accept != "" || len(rt.conditions) > 0 || rt.sub != nil
+}
+
+// coversMethods reports whether a route restricted to methods accepts every
+// method a route restricted to others does.
+func coversMethods(methods, others []string) bool {
+  if len(methods) == 0 {
+    return true
+  }
+  if len(others) == 0 {
+    return false
+  }
+  for _, other := range others {
+    if !contains(methods, other) {
+      return false
+    }
+  }
+  return true
+}
+
+// matchesAll reports whether the route's expression matches every path.
+func matchesAll(rt *Route, paths []string) bool {
+  for _, path := range paths {
+    if !rt.re.MatchString(path) {
+      return false
+    }
+  }
+  return true
+}
+
+// samples returns up to maxSamples strings matching re.
+func samples(re *syntax.Regexp) []string {
+  switch re.Op {
+  case syntax.OpNoMatch:
+    return nil
+  case syntax.OpLiteral:
+    return []string{string(re.Rune)}
+  case syntax.OpCharClass:
+    if len(re.Rune) == 0 {
+      return nil
+    }
+    first, last := string(re.Rune[0]), string(re.Rune[len(re.Rune)-1])
+    if first == last {
+      return []string{first}
+    }
+    return []string{first, last}
+  case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+    return []string{"x"}
+  case syntax.OpCapture, syntax.OpPlus:
+    return samples(re.Sub[0])
+  case syntax.OpStar, syntax.OpQuest:
+    return limit(append([]string{""}, samples(re.Sub[0])...))
+  case syntax.OpRepeat:
+    sub := samples(re.Sub[0])
+    if re.Min == 0 {
+      return limit(append([]string{""}, sub...))
+    }
+    repeated := make([]string, len(sub))
+    for i, s := range sub {
+      for n := 0; n < re.Min; n++ {
+        repeated[i] += s
+      }
+    }
+    return repeated
+  case syntax.OpConcat:
+    result := []string{""}
+    for _, sub := range re.Sub {
+      var next []string
+      for _, prefix := range result {
+        for _, s := range samples(sub) {
+          next = append(next, prefix+s)
+        }
+      }
+      if result = limit(next); len(result) == 0 {
+        return nil
+      }
+    }
+    return result
+  case syntax.OpAlternate:
+    var result []string
+    for _, sub := range re.Sub {
+      result = append(result, samples(sub)...)
+    }
+    return limit(result)
+  }
+  // Anchors, word boundaries and empty matches match the empty string.
+  return []string{""}
+}
+
+// limit truncates samples to maxSamples strings.
+func limit(samples []string) []string {
+  if len(samples) > maxSamples {
+    return samples[:maxSamples]
+  }
+  return samples
+}
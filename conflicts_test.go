@@ -0,0 +1,32 @@
+package handler
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestConflicts(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/users/.*", write("users"))
+  h.Add("/users/(\\d+)", write("user"))
+  h.Add("/posts/(\\d+)", write("post"))
+  h.Add("/posts/(new|\\d+)", write("new post"))
+  h.AddMethod("GET", "/items", write("get"))
+  h.Add("/items", write("any"))
+  h.AddHost("example\\.com", "/hosts/(.*)", write("host"))
+  h.Add("/hosts/a", write("a"))
+  if got, want := fmt.Sprint(h.Conflicts()), "[[0 1]]"; got != want {
+    t.Errorf("got %s, want %s", got, want)
+  }
+}
+
+func TestConflictsOptional(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  h.Add("/a(/b)?", write("ab"))
+  h.Add("/[a-c]", write("class"))
+  h.Add("/b", write("b"))
+  if got, want := fmt.Sprint(h.Conflicts()), "[[2 3]]"; got != want {
+    t.Errorf("got %s, want %s", got, want)
+  }
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+  "net/http"
+  "time"
+)
+
+// match is the outcome of selecting a route for a request.
+type match struct {
+  route      *Route
+  submatches []string
+  // index is the position of route among the handler's routes.
+  index int
+  // path is the string the route's expression matched against.
+  path string
+  // allowed lists the methods of routes whose expression matched the path
+  // but whose method didn't match the request's.
+  allowed []string
+  // redirect is the URL a request that matched no route is redirected to by
+  // RedirectTrailingSlash or RedirectCleanPath.
+  redirect string
+  // head is set when a HEAD request is served by a GET route through
+  // AutoHEAD.
+  head bool
+  // status, if non-zero, is the status code the request is answered with
+  // instead of serving it.
+  status int
+  // finals holds the handler's final functions if no route matched.
+  finals []func(http.ResponseWriter, *http.Request, []string)
+  // name, middleware and recover are the route's name, middleware and
+  // recover handler at the time it was selected.
+  name       string
+  middleware []func(http.Handler) http.Handler
+  recover    func(http.ResponseWriter, *http.Request, interface{})
+  // writer is the writer ServeHTTP passes down, counting the bytes written.
+  // It points to rw, so that it is allocated along with the match.
+  writer *responseWriter
+  rw     responseWriter
+  // start is the time ServeHTTP received the request.
+  start time.Time
+  // passed is set when the route passed the request through, see
+  // ErrPassThrough.
+  passed bool
+}
+
+type matchKey struct{}
+
+// matchFromContext returns the match ServeHTTP stored in the request's
+// context, or an empty match if there is none.
+func matchFromContext(r *http.Request) *match {
+  if m, ok := r.Context().Value(matchKey{}).(*match); ok {
+    return m
+  }
+  return &match{}
+}
+
+// SubmatchesFromContext returns the submatches of the route that matched the
+// request, as passed to the route's function. It returns nil if no route
+// matched, and an empty slice if the route's expression has no groups.
+func SubmatchesFromContext(r *http.Request) []string {
+  if m := matchFromContext(r); m.route != nil {
+    return m.submatches
+  }
+  return nil
+}
+
+// Adapt turns a route function into an http.HandlerFunc that reads the
+// submatches through SubmatchesFromContext, e.g. to wrap it in middleware
+// expecting a plain handler before passing it to AddHandler. Outside of
+// ServeHTTP, the function receives nil submatches.
+func Adapt(function func(http.ResponseWriter, *http.Request, []string)) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    function(w, r, SubmatchesFromContext(r))
+  }
+}
+
+// MatchedPattern returns the expression of the route that matched the
+// request, as it was added. It reports false if no route matched.
+func MatchedPattern(r *http.Request) (string, bool) {
+  if m := matchFromContext(r); m.route != nil {
+    return m.route.expression, true
+  }
+  return "", false
+}
+
+// RouteNameFromContext returns the name of the route that matched the
+// request, or "" if no route matched or the route has no name.
+func RouteNameFromContext(r *http.Request) string {
+  return matchFromContext(r).name
+}
+
+type originalPathKey struct{}
+
+// OriginalPath returns the path of the request before any prefixes were
+// stripped from it by Mount, or its path if it wasn't delegated to a mounted
+// handler.
+func OriginalPath(r *http.Request) string {
+  if path, ok := r.Context().Value(originalPathKey{}).(string); ok {
+    return path
+  }
+  return r.URL.Path
+}
+
+// MatchedIndex returns the position, counting from 0 in order of precedence,
+// of the route that matched the request among its handler's routes at the
+// time. It reports false if no route matched.
+func MatchedIndex(r *http.Request) (int, bool) {
+  if m := matchFromContext(r); m.route != nil {
+    return m.index, true
+  }
+  return 0, false
+}
+
+// BytesWritten returns the number of bytes of the response's body ServeHTTP
+// has written so far, e.g. for middleware to read after calling the next
+// handler. Bytes copied with io.Copy are included. It reports false outside of
+// ServeHTTP.
+func BytesWritten(r *http.Request) (int64, bool) {
+  if m := matchFromContext(r); m.writer != nil {
+    return m.writer.bytes, true
+  }
+  return 0, false
+}
+
+// RequestStart returns the time ServeHTTP received the request, before
+// selecting its route or running any middleware, so that middleware and
+// route functions measuring durations share the same start. It returns the
+// zero time outside of ServeHTTP.
+func RequestStart(r *http.Request) time.Time {
+  return matchFromContext(r).start
+}
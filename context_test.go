@@ -0,0 +1,241 @@
+package handler
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestSubmatchesFromContext(t *testing.T) {
+  h := NewRegexpHandler()
+  var groups, none []string
+  h.Add("/a/(\\w+)/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    groups = SubmatchesFromContext(r)
+  })
+  h.Add("/b", func(w http.ResponseWriter, r *http.Request, m []string) {
+    none = SubmatchesFromContext(r)
+  })
+  serve(h, "GET", "/a/x/1")
+  if len(groups) != 2 || groups[0] != "x" || groups[1] != "1" {
+    t.Errorf("got %q, want [x 1]", groups)
+  }
+  serve(h, "GET", "/b")
+  if none == nil || len(none) != 0 {
+    t.Errorf("got %#v for a route without groups, want an empty slice", none)
+  }
+}
+
+func TestSubmatchesFromContextNoMatch(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []string
+  called := false
+  h.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got, called = SubmatchesFromContext(r), true
+  })
+  serve(h, "GET", "/none")
+  if !called || got != nil {
+    t.Errorf("got %#v, want nil", got)
+  }
+  if got := SubmatchesFromContext(httptest.NewRequest("GET", "/", nil)); got != nil {
+    t.Errorf("got %#v outside of ServeHTTP, want nil", got)
+  }
+}
+
+func TestMatchedPattern(t *testing.T) {
+  h := NewRegexpHandler()
+  var pattern string
+  var ok bool
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      next.ServeHTTP(w, r)
+      pattern, ok = MatchedPattern(r)
+    })
+  })
+  h.Add("/users/(\\d+)", write("user"))
+  for _, path := range []string{"/users/42", "/users/99"} {
+    serve(h, "GET", path)
+    if !ok || pattern != "/users/(\\d+)" {
+      t.Errorf("%s: got %q, %v", path, pattern, ok)
+    }
+  }
+  serve(h, "GET", "/none")
+  if ok || pattern != "" {
+    t.Errorf("got %q, %v for an unmatched request", pattern, ok)
+  }
+}
+
+func TestRouteNameFromContext(t *testing.T) {
+  h := NewRegexpHandler()
+  var name string
+  f := func(w http.ResponseWriter, r *http.Request, m []string) {
+    name = RouteNameFromContext(r)
+  }
+  h.Add("/users/(\\d+)", f).Name("user")
+  h.Add("/other", f)
+  serve(h, "GET", "/users/1")
+  if name != "user" {
+    t.Errorf("got %q, want user", name)
+  }
+  serve(h, "GET", "/other")
+  if name != "" {
+    t.Errorf("got %q for an unnamed route, want \"\"", name)
+  }
+  if name := RouteNameFromContext(httptest.NewRequest("GET", "/", nil)); name != "" {
+    t.Errorf("got %q outside ServeHTTP, want \"\"", name)
+  }
+}
+
+func TestOriginalPath(t *testing.T) {
+  var got []string
+  f := func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = append(got, r.URL.Path+" "+OriginalPath(r))
+  }
+  inner := NewRegexpHandler()
+  inner.Add("/users/(\\d+)", f)
+  api := NewRegexpHandler()
+  api.Mount("/v1", inner)
+  api.Add("/status", f)
+  h := NewRegexpHandler()
+  h.Mount("/api", api)
+  h.Add("/home", f)
+  serve(h, "GET", "/api/v1/users/1")
+  serve(h, "GET", "/api/status")
+  serve(h, "GET", "/home")
+  want := "[/users/1 /api/v1/users/1 /status /api/status /home /home]"
+  if s := fmt.Sprint(got); s != want {
+    t.Errorf("got %s, want %s", s, want)
+  }
+}
+
+func TestMatchedIndex(t *testing.T) {
+  h := NewRegexpHandler()
+  var index int
+  var ok bool
+  f := func(w http.ResponseWriter, r *http.Request, m []string) {
+    index, ok = MatchedIndex(r)
+  }
+  h.Add("/a", f)
+  h.Add("/users/(\\d+)", f)
+  h.Add("/users/.*", f)
+  for path, want := range map[string]int{"/a": 0, "/users/1": 1, "/users/bob": 2} {
+    index, ok = -1, false
+    if serve(h, "GET", path); !ok || index != want {
+      t.Errorf("%s: got %d %v, want %d", path, index, ok, want)
+    }
+  }
+  var found bool
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      _, found = MatchedIndex(r)
+      next.ServeHTTP(w, r)
+    })
+  })
+  if serve(h, "GET", "/missing"); found {
+    t.Error("got an index for a request no route matched")
+  }
+}
+
+func TestAdapt(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []string
+  f := Adapt(func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = m
+    w.Write([]byte("ok"))
+  })
+  h.AddHandler("/users/(\\d+)", http.TimeoutHandler(f, time.Second, "timeout"))
+  if rec := serve(h, "GET", "/users/42"); rec.Body.String() != "ok" || fmt.Sprint(got) != "[42]" {
+    t.Errorf("got %q with submatches %v, want [42] through the timeout handler", rec.Body.String(), got)
+  }
+  got = []string{"x"}
+  f(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+  if got != nil {
+    t.Errorf("got %v outside ServeHTTP, want nil", got)
+  }
+}
+
+// readerFromRecorder is a ResponseRecorder that implements io.ReaderFrom, as
+// the writers of net/http's server do to use sendfile.
+type readerFromRecorder struct {
+  *httptest.ResponseRecorder
+  readFrom bool
+}
+
+func (w *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+  w.readFrom = true
+  return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestBytesWritten(t *testing.T) {
+  payload := strings.Repeat("x", 10000)
+  h := NewRegexpHandler()
+  var got []int64
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      next.ServeHTTP(w, r)
+      n, ok := BytesWritten(r)
+      if !ok {
+        t.Error("BytesWritten reported false in middleware")
+      }
+      got = append(got, n)
+    })
+  })
+  h.Add("/write", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(payload[:100]))
+    w.Write([]byte(payload[100:]))
+  })
+  h.Add("/copy", func(w http.ResponseWriter, r *http.Request, m []string) {
+    // Hide strings.Reader's WriteTo so that io.Copy uses the writer's ReadFrom.
+    io.Copy(w, struct{ io.Reader }{strings.NewReader(payload)})
+  })
+  h.Add("/empty", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.WriteHeader(http.StatusNoContent)
+  })
+  serve(h, "GET", "/write")
+  rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+  h.ServeHTTP(rec, httptest.NewRequest("GET", "/copy", nil))
+  if !rec.readFrom || rec.Body.Len() != len(payload) {
+    t.Errorf("got %d bytes, ReadFrom used %v; want %d through ReadFrom", rec.Body.Len(), rec.readFrom, len(payload))
+  }
+  h.ServerTiming = true
+  serve(h, "GET", "/copy")
+  serve(h, "GET", "/empty")
+  if want := fmt.Sprint([]int64{10000, 10000, 10000, 0}); fmt.Sprint(got) != want {
+    t.Errorf("got byte counts %v, want %s", got, want)
+  }
+  if _, ok := BytesWritten(httptest.NewRequest("GET", "/", nil)); ok {
+    t.Error("BytesWritten reported true outside of ServeHTTP")
+  }
+}
+
+func TestRequestStart(t *testing.T) {
+  h := NewRegexpHandler()
+  var entered, inMiddleware, inRoute time.Time
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      entered, inMiddleware = time.Now(), RequestStart(r)
+      next.ServeHTTP(w, r)
+    })
+  })
+  h.Add("/a", func(w http.ResponseWriter, r *http.Request, m []string) {
+    time.Sleep(time.Millisecond)
+    inRoute = RequestStart(r)
+  })
+  before := time.Now()
+  serve(h, "GET", "/a")
+  if inMiddleware.IsZero() || !inMiddleware.Equal(inRoute) {
+    t.Fatalf("got %v in middleware and %v in the route, want the same start", inMiddleware, inRoute)
+  }
+  if inMiddleware.Before(before) || inMiddleware.After(entered) {
+    t.Errorf("got a start of %v, want it between %v and the middleware's %v", inMiddleware, before, entered)
+  }
+  if !strings.Contains(inRoute.String(), "m=") || time.Since(inRoute) < time.Millisecond {
+    t.Errorf("got %v, want a start with a monotonic reading", inRoute)
+  }
+  if start := RequestStart(httptest.NewRequest("GET", "/", nil)); !start.IsZero() {
+    t.Errorf("got %v outside of ServeHTTP, want the zero time", start)
+  }
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "strings"
+)
+
+// Explain describes how a request is matched against the handler's routes,
+// for debugging. It lists each route in order of precedence with whether it
+// matches the request and, if not, why, and ends with the route that would
+// serve the request or "no match". No route function is called, and the
+// request's body isn't read, see Match.
+func (h *RegexpHandler) Explain(r *http.Request) string {
+  r, redirect := h.cleanPath(h.overrideMethod(r, false))
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  var b strings.Builder
+  path := h.path(r)
+  fmt.Fprintf(&b, "%s %q\n", h.method(r), path)
+  if h.Matcher != nil {
+    b.WriteString("routes selected by the handler's Matcher\n")
+  } else {
+    for i, rt := range h.routes {
+      fmt.Fprintf(&b, "%d %q", i, rt.expression)
+      if len(rt.methods) > 0 {
+        fmt.Fprintf(&b, " [%s]", strings.Join(rt.methods, ", "))
+      }
+      b.WriteString(": ")
+      if _, ok := rt.submatches(path); !ok {
+        b.WriteString("path does not match\n")
+      } else if reason := rt.rejection(r); reason != "" {
+        b.WriteString(reason + "\n")
+      } else if !rt.matchesMethod(h.method(r)) {
+        b.WriteString("method does not match\n")
+      } else {
+        b.WriteString("matches\n")
+      }
+    }
+  }
+  if redirect == "" {
+    redirect = h.canonicalHostRedirect(r)
+  }
+  if redirect != "" {
+    fmt.Fprintf(&b, "redirect to %q", redirect)
+    return b.String()
+  }
+  m := h.match(h.routes, h.combined, r)
+  switch {
+  case m.status != 0:
+    fmt.Fprintf(&b, "answered with %d %s", m.status, http.StatusText(m.status))
+  case m.route != nil:
+    fmt.Fprintf(&b, "served by %d %q", m.index, m.route.expression)
+    if m.head {
+      b.WriteString(" as GET")
+    }
+  case m.redirect != "":
+    fmt.Fprintf(&b, "redirect to %q", m.redirect)
+  default:
+    b.WriteString("no match")
+  }
+  return b.String()
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestExplain(t *testing.T) {
+  h := NewRegexpHandler()
+  called := false
+  h.AddHost("api\\.example\\.com", "/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  h.AddMethod("POST", "/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  h.Add("/posts", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  h.Add("/users/.*", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  got := h.Explain(request("GET", "/users/42", "example.com"))
+  for _, want := range []string{
+    `GET "/users/42"`,
+    `0 "/users/(\\d+)": host does not match`,
+    `1 "/users/(\\d+)" [POST]: method does not match`,
+    `2 "/posts": path does not match`,
+    `3 "/users/.*": matches`,
+  } {
+    if !strings.Contains(got, want+"\n") {
+      t.Errorf("explanation lacks %q:\n%s", want, got)
+    }
+  }
+  if !strings.HasSuffix(got, `served by 3 "/users/.*"`) {
+    t.Errorf("explanation doesn't name the winner:\n%s", got)
+  }
+  if called {
+    t.Error("Explain called a route function")
+  }
+  if got := h.Explain(request("GET", "/none", "example.com")); !strings.HasSuffix(got, "no match") {
+    t.Errorf("got %q, want it to end with no match", got)
+  }
+}
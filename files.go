@@ -0,0 +1,144 @@
+package handler
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "net/http"
+  "os"
+  "path"
+  "strings"
+)
+
+// AddFileServer registers a route that serves files from root. The first
+// submatch of the expression is the name of the file to serve, e.g. with
+// "/static/(.*)" a request for /static/css/app.css serves css/app.css.
+//
+// Names containing a ".." element are rejected with 403 Forbidden, and
+// missing files and directories are answered with 404 Not Found. Responses
+// carry an ETag, so that conditional requests can be answered with 304 Not
+// Modified. AddFileServer returns an error if the expression cannot be
+// compiled or has no groups.
+func (h *RegexpHandler) AddFileServer(expression string, root http.FileSystem) error {
+  re, err := h.compile(expression)
+  if err != nil {
+    return err
+  }
+  if re.NumSubexp() == 0 {
+    return fmt.Errorf("handler: expression %q has no groups", expression)
+  }
+  return h.register(&Route{expression: expression, re: re, f: func(w http.ResponseWriter, r *http.Request, m []string) {
+    serveFile(w, r, root, m[0])
+  }})
+}
+
+// AddFS is like AddFileServer, but serves files from fsys, e.g. an embed.FS.
+// Names must be valid according to fs.ValidPath, so names with a leading
+// slash or a "." or ".." element are rejected with 400 Bad Request.
+func (h *RegexpHandler) AddFS(expression string, fsys fs.FS) error {
+  re, err := h.compile(expression)
+  if err != nil {
+    return err
+  }
+  if re.NumSubexp() == 0 {
+    return fmt.Errorf("handler: expression %q has no groups", expression)
+  }
+  return h.register(&Route{expression: expression, re: re, f: func(w http.ResponseWriter, r *http.Request, m []string) {
+    serveFS(w, r, fsys, m[0])
+  }})
+}
+
+// serveFS serves the file with the given name from fsys.
+func serveFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+  if !fs.ValidPath(name) {
+    http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+    return
+  }
+  f, err := fsys.Open(name)
+  if err != nil {
+    fileError(w, err)
+    return
+  }
+  defer f.Close()
+  d, err := f.Stat()
+  if err != nil {
+    fileError(w, err)
+    return
+  }
+  if d.IsDir() {
+    http.NotFound(w, r)
+    return
+  }
+  content, ok := f.(io.ReadSeeker)
+  if !ok {
+    b, err := io.ReadAll(f)
+    if err != nil {
+      fileError(w, err)
+      return
+    }
+    content = bytes.NewReader(b)
+  }
+  setETag(w, d)
+  http.ServeContent(w, r, d.Name(), d.ModTime(), content)
+}
+
+// serveFile serves the file with the given name from root.
+func serveFile(w http.ResponseWriter, r *http.Request, root http.FileSystem, name string) {
+  if containsDotDot(name) {
+    http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+    return
+  }
+  f, err := root.Open(path.Clean("/" + name))
+  if err != nil {
+    fileError(w, err)
+    return
+  }
+  defer f.Close()
+  d, err := f.Stat()
+  if err != nil {
+    fileError(w, err)
+    return
+  }
+  if d.IsDir() {
+    http.NotFound(w, r)
+    return
+  }
+  setETag(w, d)
+  http.ServeContent(w, r, d.Name(), d.ModTime(), f)
+}
+
+// setETag sets a weak ETag derived from a file's size and modification time,
+// which http.ServeContent compares with the request's If-None-Match header.
+// Files without a modification time, such as those of an embed.FS, get no
+// ETag, since their size alone doesn't tell versions apart.
+func setETag(w http.ResponseWriter, d fs.FileInfo) {
+  if d.ModTime().IsZero() || w.Header().Get("Etag") != "" {
+    return
+  }
+  w.Header().Set("Etag", fmt.Sprintf(`W/"%x-%x"`, d.Size(), d.ModTime().UnixNano()))
+}
+
+// fileError responds to a request with the status code matching an error
+// opening a file.
+func fileError(w http.ResponseWriter, err error) {
+  switch {
+  case errors.Is(err, os.ErrNotExist):
+    http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+  case errors.Is(err, os.ErrPermission):
+    http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+  default:
+    http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+  }
+}
+
+// containsDotDot reports whether name contains a ".." path element.
+func containsDotDot(name string) bool {
+  for _, elem := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+    if elem == ".." {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "testing/fstest"
+  "time"
+)
+
+// testFS holds the files served by the tests.
+var testFS = fstest.MapFS{
+  "css/app.css": {Data: []byte("body{}"), ModTime: time.Unix(1500000000, 0)},
+  "index.html":  {Data: []byte("<p>hi</p>")},
+  "dir/a.txt":   {Data: []byte("a")},
+}
+
+func TestAddFileServer(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddFileServer("/static/(.*)", http.FS(testFS)); err != nil {
+    t.Fatal(err)
+  }
+  rec := serve(h, "GET", "/static/css/app.css")
+  if rec.Code != http.StatusOK || rec.Body.String() != "body{}" {
+    t.Errorf("got %d %q, want the file", rec.Code, rec.Body.String())
+  }
+  for path, code := range map[string]int{
+    "/static/missing.css":  http.StatusNotFound,
+    "/static/dir":          http.StatusNotFound,
+    "/static/../secret":    http.StatusForbidden,
+    "/static/css/../x.css": http.StatusForbidden,
+  } {
+    if rec := serve(h, "GET", path); rec.Code != code {
+      t.Errorf("%s: got %d, want %d", path, rec.Code, code)
+    }
+  }
+}
+
+func TestAddFileServerNoGroups(t *testing.T) {
+  if err := NewRegexpHandler().AddFileServer("/static/.*", http.FS(testFS)); err == nil {
+    t.Error("expression without groups returned nil error")
+  }
+}
+
+func TestAddFS(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddFS("/static/(.*)", testFS); err != nil {
+    t.Fatal(err)
+  }
+  rec := serve(h, "GET", "/static/css/app.css")
+  if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/css; charset=utf-8" {
+    t.Fatalf("got %d with Content-Type %q, want the stylesheet", rec.Code, rec.Header().Get("Content-Type"))
+  }
+  r := httptest.NewRequest("GET", "/static/css/app.css", nil)
+  r.Header.Set("If-Modified-Since", rec.Header().Get("Last-Modified"))
+  cached := httptest.NewRecorder()
+  h.ServeHTTP(cached, r)
+  if cached.Code != http.StatusNotModified {
+    t.Errorf("got %d, want 304 for an unmodified file", cached.Code)
+  }
+  for path, want := range map[string]int{
+    "/static/missing.css":  http.StatusNotFound,
+    "/static/dir":          http.StatusNotFound,
+    "/static/./index.html": http.StatusBadRequest,
+    "/static//index.html":  http.StatusBadRequest,
+  } {
+    if rec := serve(h, "GET", path); rec.Code != want {
+      t.Errorf("%s: got %d, want %d", path, rec.Code, want)
+    }
+  }
+}
+
+func TestFileServerETag(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddFileServer("/static/(.*)", http.FS(testFS)); err != nil {
+    t.Fatal(err)
+  }
+  rec := serve(h, "GET", "/static/css/app.css")
+  etag := rec.Header().Get("Etag")
+  if !strings.HasPrefix(etag, `W/"`) {
+    t.Fatalf("got ETag %q, want a weak ETag", etag)
+  }
+  for _, test := range []struct {
+    header, value string
+    code          int
+  }{
+    {"If-None-Match", etag, http.StatusNotModified},
+    {"If-None-Match", `W/"other"`, http.StatusOK},
+    {"If-Modified-Since", rec.Header().Get("Last-Modified"), http.StatusNotModified},
+  } {
+    r := httptest.NewRequest("GET", "/static/css/app.css", nil)
+    r.Header.Set(test.header, test.value)
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, r)
+    if rec.Code != test.code {
+      t.Errorf("%s %s: got %d, want %d", test.header, test.value, rec.Code, test.code)
+    }
+    if test.code == http.StatusNotModified && rec.Body.Len() != 0 {
+      t.Errorf("%s: got a body with 304", test.header)
+    }
+  }
+  // Files without a modification time get no ETag.
+  if etag := serve(h, "GET", "/static/index.html").Header().Get("Etag"); etag != "" {
+    t.Errorf("got ETag %q for a file without a modification time", etag)
+  }
+}
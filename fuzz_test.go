@@ -0,0 +1,83 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+)
+
+// FuzzServeHTTP checks that arbitrary paths never make route selection panic,
+// and that the route Match reports does match the path with the submatches
+// it reports.
+func FuzzServeHTTP(f *testing.F) {
+  for _, seed := range []string{
+    "/",
+    "",
+    "/users/42",
+    "/users/42/",
+    "/users//42",
+    "/users/x/../42",
+    "/files/a%2Fb",
+    "/files/%zz",
+    "//example.com",
+    "/\\example.com",
+    "/static/../secret",
+    "/a\x00b",
+    "/\xff\xfe",
+    "/é/ü",
+    "/" + strings.Repeat("a", 1000),
+    "/opt/x/y/",
+  } {
+    f.Add(seed, "GET")
+  }
+  f.Add("/users/42", "post")
+  f.Add("/users/42", "HEAD")
+  f.Fuzz(func(t *testing.T, path, method string) {
+    if method == "" || strings.ContainsAny(method, " \r\n") {
+      return
+    }
+    for _, h := range fuzzHandlers() {
+      r := &http.Request{Method: method, URL: &url.URL{Path: path}, Host: "example.com", Header: http.Header{}}
+      rt, submatches, ok := h.Match(r)
+      if ok {
+        // Match sees the path after cleaning, if configured.
+        cleaned, _ := h.cleanPath(r)
+        all := rt.re.FindStringSubmatch(h.path(cleaned))
+        if all == nil {
+          t.Fatalf("Match(%q) reported %q, whose expression doesn't match", path, rt.expression)
+        }
+        if fmt.Sprintf("%q", all[1:]) != fmt.Sprintf("%q", submatches) {
+          t.Fatalf("Match(%q) reported submatches %q for %q, want %q", path, submatches, rt.expression, all[1:])
+        }
+      }
+      h.ServeHTTP(httptest.NewRecorder(), r)
+    }
+  })
+}
+
+// fuzzHandlers returns handlers with a representative route table, each with
+// different settings.
+func fuzzHandlers() []*RegexpHandler {
+  plain := NewRegexpHandler()
+  clean := NewRegexpHandler()
+  clean.CleanPath, clean.CaseInsensitive, clean.RedirectTrailingSlash = true, true, true
+  prefix := NewRegexpHandler()
+  prefix.AnchorMode = AnchorStart
+  hs := []*RegexpHandler{plain, clean, prefix}
+  f := func(w http.ResponseWriter, r *http.Request, m []string) {}
+  for _, h := range hs {
+    h.Add("/", f)
+    h.AddMethod("GET", "/users/(\\d+)", f)
+    h.AddMethods([]string{"POST", "PUT"}, "/users/(\\d+)", f)
+    h.Add("/users/(\\d+)/posts/(?P<post>\\d+)", f)
+    h.Add("/files/(.+)", f)
+    h.Add("/opt(/x)?(/y)?/?", f)
+    h.Add("/static/(.*)", f)
+    h.Add("/(é|ü)/(.*)", f)
+    h.Add("/a.b", f)
+  }
+  return hs
+}
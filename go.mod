@@ -0,0 +1,3 @@
+module github.com/perriv/go-http-regexp-handler
+
+go 1.19
@@ -0,0 +1,70 @@
+package handler
+
+import (
+  "net/http"
+  "regexp"
+)
+
+// Group registers routes sharing a path prefix and middleware, see
+// RegexpHandler.Group.
+type Group struct {
+  h          *RegexpHandler
+  parent     *Group
+  prefix     string
+  middleware []func(http.Handler) http.Handler
+}
+
+// Group returns a group whose routes are registered with h, in order with h's
+// other routes, with prefix prepended to their expressions. The prefix is
+// matched literally. For example, routes added to h.Group("/api") with the
+// expression "/users/(\\d+)" match /api/users/42.
+func (h *RegexpHandler) Group(prefix string) *Group {
+  return &Group{h: h, prefix: prefix}
+}
+
+// Group returns a group nested in g, whose routes have both prefixes and
+// both groups' middleware.
+func (g *Group) Group(prefix string) *Group {
+  return &Group{h: g.h, parent: g, prefix: g.prefix + prefix}
+}
+
+// Use appends a middleware to the group. It wraps requests served by the
+// group's routes, including those added before, and runs after the handler's
+// middleware and before the routes' own.
+func (g *Group) Use(middleware func(http.Handler) http.Handler) {
+  g.h.mu.Lock()
+  g.middleware = append(g.middleware, middleware)
+  g.h.mu.Unlock()
+}
+
+// Add is like RegexpHandler.Add for the group's routes.
+func (g *Group) Add(expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return g.h.addRoute(g.newRoute(expression, function))
+}
+
+// AddMethod is like RegexpHandler.AddMethod for the group's routes.
+func (g *Group) AddMethod(method, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt := g.newRoute(expression, function)
+  rt.methods = upper([]string{method})
+  return g.h.addRoute(rt)
+}
+
+// newRoute returns an unregistered route of the group, with the group's
+// prefix prepended to expression.
+func (g *Group) newRoute(expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := g.h.newRoute(regexp.QuoteMeta(g.prefix)+expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.group = g
+  return rt
+}
+
+// chain returns the middleware of the group and its parents, outermost
+// first. It must be called with the handler's lock held.
+func (g *Group) chain() []func(http.Handler) http.Handler {
+  if g.parent == nil {
+    return g.middleware
+  }
+  return append(append([]func(http.Handler) http.Handler(nil), g.parent.chain()...), g.middleware...)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+)
+
+func TestGroup(t *testing.T) {
+  h := NewRegexpHandler()
+  var log []string
+  h.Use(record(&log, "parent"))
+  api := h.Group("/api.v1")
+  api.Use(record(&log, "api"))
+  api.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, fmt.Sprint("user", m))
+  })
+  admin := api.Group("/admin")
+  admin.Use(record(&log, "admin"))
+  admin.Add("/stats", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, "stats")
+  })
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, "ungrouped")
+  })
+  for _, test := range []struct {
+    path string
+    want string
+  }{
+    {"/api.v1/users/42", "[parent[42] api[42] user[42]]"},
+    {"/api.v1/admin/stats", "[parent[] api[] admin[] stats]"},
+    {"/apixv1/users/42", "[parent[]]"},
+    {"/users/42", "[parent[42] ungrouped]"},
+  } {
+    log = nil
+    serve(h, "GET", test.path)
+    if got := fmt.Sprint(log); got != test.want {
+      t.Errorf("%s: got %s, want %s", test.path, got, test.want)
+    }
+  }
+}
+
+func TestGroupAddMethod(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RejectDuplicates = true
+  api := h.Group("/api")
+  api.AddMethod("POST", "/users", write("post"))
+  api.Add("/users", write("any"))
+  // The route is registered with its method, so it isn't a duplicate of the
+  // route for any method.
+  api.AddMethod("DELETE", "/users", write("delete"))
+  if h.Len() != 3 {
+    t.Errorf("got %d routes, want 3", h.Len())
+  }
+  for method, want := range map[string]string{"POST": "post", "GET": "any"} {
+    if body := serve(h, method, "/api/users").Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", method, body, want)
+    }
+  }
+}
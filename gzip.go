@@ -0,0 +1,222 @@
+package handler
+
+import (
+  "bufio"
+  "compress/gzip"
+  "errors"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// Gzip returns a middleware, for use with Use, that compresses responses
+// with gzip when the request's Accept-Encoding allows it. Responses with
+// fewer than minSize bytes of body are sent uncompressed, as are responses
+// that already have a Content-Encoding or whose Content-Type is already
+// compressed, such as images, video and archives.
+func Gzip(minSize int) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.Header().Add("Vary", "Accept-Encoding")
+      if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+        next.ServeHTTP(w, r)
+        return
+      }
+      gw := &gzipWriter{ResponseWriter: w, minSize: minSize}
+      defer gw.close()
+      next.ServeHTTP(gw, r)
+    })
+  }
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+  for _, part := range strings.Split(header, ",") {
+    coding, params, _ := strings.Cut(part, ";")
+    coding = strings.ToLower(strings.TrimSpace(coding))
+    if coding != "gzip" && coding != "*" {
+      continue
+    }
+    if q, ok := cutQuality(params); ok && q <= 0 {
+      continue
+    }
+    return true
+  }
+  return false
+}
+
+// cutQuality returns the value of the q parameter in params, if any.
+func cutQuality(params string) (float64, bool) {
+  for _, param := range strings.Split(params, ";") {
+    key, value, _ := strings.Cut(param, "=")
+    if strings.TrimSpace(key) != "q" {
+      continue
+    }
+    q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+    if err != nil {
+      return 0, true
+    }
+    return q, true
+  }
+  return 0, false
+}
+
+// compressedType reports whether content of the given type is already
+// compressed, so that compressing it again would be wasted effort.
+func compressedType(contentType string) bool {
+  contentType, _, _ = strings.Cut(strings.ToLower(contentType), ";")
+  contentType = strings.TrimSpace(contentType)
+  switch {
+  case strings.HasPrefix(contentType, "image/") && contentType != "image/svg+xml",
+    strings.HasPrefix(contentType, "video/"),
+    strings.HasPrefix(contentType, "audio/"):
+    return true
+  }
+  switch contentType {
+  case "application/zip", "application/gzip", "application/x-gzip",
+    "application/x-bzip2", "application/x-xz", "application/zstd",
+    "application/x-7z-compressed", "application/x-rar-compressed",
+    "font/woff", "font/woff2":
+    return true
+  }
+  return false
+}
+
+// gzipWriter wraps an http.ResponseWriter to compress the response. It holds
+// back the header and the first minSize bytes of the body until it knows
+// whether the response is worth compressing.
+type gzipWriter struct {
+  http.ResponseWriter
+  minSize int
+  status  int
+  buf     []byte
+  // decided is set once the header has been sent, with gz set if the body
+  // is being compressed.
+  decided bool
+  gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+  if w.decided || w.status != 0 {
+    return
+  }
+  if status < 200 {
+    w.ResponseWriter.WriteHeader(status)
+    return
+  }
+  w.status = status
+  if status == http.StatusNoContent || status == http.StatusNotModified || !w.compressible() {
+    w.decide(false)
+  }
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  if !w.decided {
+    if w.Header().Get("Content-Type") == "" {
+      w.Header().Set("Content-Type", http.DetectContentType(append(w.buf, b...)))
+    }
+    if !w.compressible() {
+      w.decide(false)
+    } else if len(w.buf)+len(b) < w.minSize {
+      w.buf = append(w.buf, b...)
+      return len(b), nil
+    } else {
+      w.decide(true)
+    }
+  }
+  if w.gz != nil {
+    return w.gz.Write(b)
+  }
+  return w.ResponseWriter.Write(b)
+}
+
+// compressible reports whether the response's header allows compressing it.
+func (w *gzipWriter) compressible() bool {
+  header := w.Header()
+  return header.Get("Content-Encoding") == "" && !compressedType(header.Get("Content-Type"))
+}
+
+// decide sends the header, compressing the body from now on if compress is
+// set, followed by any data held back so far.
+func (w *gzipWriter) decide(compress bool) {
+  w.decided = true
+  if compress {
+    header := w.Header()
+    header.Set("Content-Encoding", "gzip")
+    header.Del("Content-Length")
+    w.gz = gzip.NewWriter(w.ResponseWriter)
+  }
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  w.ResponseWriter.WriteHeader(w.status)
+  if len(w.buf) == 0 {
+    return
+  }
+  if w.gz != nil {
+    w.gz.Write(w.buf)
+  } else {
+    w.ResponseWriter.Write(w.buf)
+  }
+  w.buf = nil
+}
+
+// Flush sends any data held back or buffered by the compressor to the
+// client, compressing the response if it may be compressed at all.
+func (w *gzipWriter) Flush() {
+  if !w.decided {
+    w.decide(w.compressible())
+  }
+  if w.gz != nil {
+    w.gz.Flush()
+  }
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// Hijack takes over the connection if the wrapped writer is an http.Hijacker.
+// Nothing more is written on the response's behalf once it succeeds.
+func (w *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  h, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("handler: response writer does not implement http.Hijacker")
+  }
+  conn, rw, err := h.Hijack()
+  if err == nil {
+    w.decided, w.buf, w.gz = true, nil, nil
+  }
+  return conn, rw, err
+}
+
+// Push initiates an HTTP/2 server push if the wrapped writer is an
+// http.Pusher, and returns http.ErrNotSupported otherwise.
+func (w *gzipWriter) Push(target string, opts *http.PushOptions) error {
+  if p, ok := w.ResponseWriter.(http.Pusher); ok {
+    return p.Push(target, opts)
+  }
+  return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+// close finishes the response, sending it uncompressed if it never reached
+// minSize bytes.
+func (w *gzipWriter) close() {
+  if !w.decided {
+    if w.status == 0 && len(w.buf) == 0 {
+      return
+    }
+    w.decide(false)
+  }
+  if w.gz != nil {
+    w.gz.Close()
+  }
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+  "compress/gzip"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// gzipHandler returns a handler compressing responses of at least 100 bytes.
+func gzipHandler() *RegexpHandler {
+  h := NewRegexpHandler()
+  h.Use(Gzip(100))
+  h.Add("/large", write(strings.Repeat("hello, world\n", 100)))
+  h.Add("/small", write("hello"))
+  h.Add("/image", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Header().Set("Content-Type", "image/png")
+    w.Write(make([]byte, 1000))
+  })
+  h.Add("/created", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte(strings.Repeat("a", 1000)))
+  })
+  return h
+}
+
+// get sends a GET request accepting gzip to h.
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+  r := httptest.NewRequest("GET", path, nil)
+  r.Header.Set("Accept-Encoding", "gzip")
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  return rec
+}
+
+func TestGzip(t *testing.T) {
+  h := gzipHandler()
+  for _, test := range []struct {
+    path   string
+    status int
+    size   int
+  }{
+    {"/large", http.StatusOK, 1300},
+    {"/created", http.StatusCreated, 1000},
+  } {
+    path, status := test.path, test.status
+    rec := get(h, path)
+    if rec.Code != status || rec.Header().Get("Content-Encoding") != "gzip" {
+      t.Fatalf("%s: got %d with Content-Encoding %q, want %d gzipped", path, rec.Code, rec.Header().Get("Content-Encoding"), status)
+    }
+    zr, err := gzip.NewReader(rec.Body)
+    if err != nil {
+      t.Fatal(err)
+    }
+    body, err := io.ReadAll(zr)
+    if err != nil || len(body) != test.size {
+      t.Errorf("%s: got %d bytes, %v; want %d", path, len(body), err, test.size)
+    }
+  }
+}
+
+func TestGzipSkipped(t *testing.T) {
+  h := gzipHandler()
+  for _, path := range []string{"/small", "/image"} {
+    if rec := get(h, path); rec.Header().Get("Content-Encoding") != "" {
+      t.Errorf("%s: got Content-Encoding %q, want none", path, rec.Header().Get("Content-Encoding"))
+    }
+  }
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, httptest.NewRequest("GET", "/large", nil))
+  if rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 1300 {
+    t.Errorf("got Content-Encoding %q, want none without Accept-Encoding", rec.Header().Get("Content-Encoding"))
+  }
+  if rec.Header().Get("Vary") != "Accept-Encoding" {
+    t.Errorf("got Vary %q, want Accept-Encoding", rec.Header().Get("Vary"))
+  }
+}
+
+func TestGzipFlush(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Use(Gzip(1000))
+  h.Add("/stream", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte("event"))
+    w.(http.Flusher).Flush()
+  })
+  rec := get(h, "/stream")
+  if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+    t.Errorf("got flushed %v with Content-Encoding %q, want a flushed gzip stream", rec.Flushed, rec.Header().Get("Content-Encoding"))
+  }
+}
+
+func TestGzipHijackAndPush(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Use(Gzip(0))
+  h.Add("/ws", func(w http.ResponseWriter, r *http.Request, m []string) {
+    if err := w.(http.Pusher).Push("/app.js", nil); err != nil {
+      t.Errorf("Push: %v", err)
+    }
+    if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+      t.Errorf("Hijack: %v", err)
+    }
+  })
+  w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+  r := httptest.NewRequest("GET", "/ws", nil)
+  r.Header.Set("Accept-Encoding", "gzip")
+  h.ServeHTTP(w, r)
+  if !w.hijacked || len(w.pushed) != 1 {
+    t.Errorf("got hijacked %v, pushed %v; want gzip to forward both", w.hijacked, w.pushed)
+  }
+  if w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+    t.Error("gzip wrote a response after the connection was hijacked")
+  }
+}
@@ -12,22 +12,370 @@
 // precedence heirachy that you may take advantage of.  Furthermore, if the
 // path doesn't match any regular expression, the handler won't do anything. It
 // is then useful to register a route with a catch-all regular expression (e.g.
-// ".*") that could serve a 404 error.
+// ".*") that could serve a 404 error, or to set the handler's NotFound field.
 package handler
 
 import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "math/rand"
+  "mime"
+  "net"
   "net/http"
+  "net/http/httptest"
+  "net/url"
+  "path"
   "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
 )
 
-type route struct {
-  re   *regexp.Regexp
-  f    func(http.ResponseWriter, *http.Request, []string)
+// AnchorMode controls how Add anchors expressions.
+type AnchorMode int
+
+const (
+  // AnchorBoth anchors expressions at the start and end, so that they must
+  // match the entire path.
+  AnchorBoth AnchorMode = iota
+  // AnchorStart anchors expressions at the start only, so that they match
+  // any path they are a prefix of.
+  AnchorStart
+  // AnchorNone doesn't anchor expressions, so that they match any path they
+  // occur in.
+  AnchorNone
+  // AnchorEnd anchors expressions at the end only, so that they match any
+  // path they are a suffix of, e.g. "\\.json" matches /api/v1/data.json.
+  // Matches may start at any offset in the path.
+  AnchorEnd
+)
+
+// MatchMode controls which route serves a request when several match it.
+type MatchMode int
+
+const (
+  // MatchFirst selects the route that was registered first.
+  MatchFirst MatchMode = iota
+  // MatchSpecific selects the most specific route, i.e. the one whose
+  // expression contains the most literal characters. Only characters that
+  // every match of the expression must contain are counted, so characters
+  // within alternations, character classes and anything that may repeat zero
+  // times are not. For example, "/users/new" (10) is more specific than
+  // "/users/([^/]+)" (7). Ties are broken by registration order.
+  MatchSpecific
+)
+
+// ErrDuplicateRoute is returned when registering a route that duplicates an
+// existing one while RejectDuplicates is set.
+var ErrDuplicateRoute = errors.New("handler: duplicate route")
+
+// ErrPassThrough can be returned by functions added through AddErr to decline
+// a request, so that the next route matching it serves it instead, or
+// NotFound if none does.
+var ErrPassThrough = errors.New("handler: pass through")
+
+// LimitMode controls what happens to requests exceeding the concurrency limit
+// of a route added through AddLimit.
+type LimitMode int
+
+const (
+  // LimitBlock makes requests wait until fewer requests are in flight, or
+  // until they are canceled.
+  LimitBlock LimitMode = iota
+  // LimitReject answers requests with 503 Service Unavailable right away.
+  LimitReject
+)
+
+// statusClientClosed is the status requests are reported with when
+// SkipCancelled skips them, as used by nginx for requests whose client closed
+// the connection.
+const statusClientClosed = 499
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+  // Expression is the expression the route was added with.
+  Expression string
+  // Method lists the methods the route is restricted to, separated by ", ",
+  // or is "" if the route matches any method.
+  Method string
+}
+
+// RouteStats summarizes the registered routes, see Stats.
+type RouteStats struct {
+  // Routes is the number of routes.
+  Routes int
+  // ByMethod counts the routes accepting each method, in upper case. Routes
+  // restricted to several methods are counted once for each; routes that
+  // match any method are counted under "".
+  ByMethod map[string]int
+  // Named is the number of routes with a name.
+  Named int
 }
 
 // RegexpHandler is an object that implements the http.Handler interface.
+//
+// Routes may be registered concurrently with ServeHTTP. Configuration fields
+// should be set before the handler starts serving requests.
 type RegexpHandler struct {
-  routes []*route
+  // MethodNotAllowed makes ServeHTTP respond with 405 Method Not Allowed when
+  // the request's path matches one or more routes but none of them accept the
+  // request's method. The Allow header lists the methods of those routes.
+  MethodNotAllowed bool
+
+  // HandleOPTIONS makes ServeHTTP respond to OPTIONS requests with 204 No
+  // Content when the request's path matches one or more routes but none of
+  // them accept OPTIONS. The Allow header lists the methods of those routes.
+  // Routes that accept OPTIONS take precedence.
+  HandleOPTIONS bool
+
+  // AutoHEAD makes routes that accept GET serve HEAD requests that no route
+  // accepts. The response's header and status code are sent as the route
+  // writes them, but its body is discarded.
+  AutoHEAD bool
+
+  // NotFound, if non-nil, serves requests that don't match any route. Unlike a
+  // catch-all route, it always runs after every route has been considered.
+  NotFound http.Handler
+
+  // WriteNotFound makes ServeHTTP answer requests that don't match any route
+  // with 404 Not Found when NotFound is nil. Without it, nothing is written,
+  // so net/http sends an empty 200 OK response.
+  WriteNotFound bool
+
+  // CaseInsensitive makes Add and its variants compile expressions with the
+  // (?i) flag. It is read when a route is added, so changing it doesn't affect
+  // routes that are already registered.
+  CaseInsensitive bool
+
+  // AnchorMode controls how Add and its variants anchor expressions. The
+  // default, AnchorBoth, requires expressions to match the entire path. Like
+  // CaseInsensitive, it is read when a route is added, so routes added under
+  // different modes can be mixed freely.
+  AnchorMode AnchorMode
+
+  // TolerateLeadingSlash makes Add and its variants accept paths whether or
+  // not they start with "/", whether or not the expression does: under
+  // AnchorBoth and AnchorStart, a leading "/" is removed from the expression
+  // and "/?" anchored in its place, so that "users/(\\d+)" and
+  // "/users/(\\d+)" both match /users/42 as well as users/42. Since "/?"
+  // consumes the slash first, a group at the start of the expression, such as
+  // that of "(.*)", never captures it. A slash inside such a group, as in
+  // "(/users)/\\d+", is not removed, so the path must still start with it.
+  // Like AnchorMode, it is read when a route is added.
+  TolerateLeadingSlash bool
+
+  // MatchMode controls which route serves a request when several match it.
+  // The default, MatchFirst, selects the route that was registered first.
+  MatchMode MatchMode
+
+  // Matcher, if non-nil, replaces the handler's own route selection. Since it
+  // only sees the path and method of requests, requirements such as hosts
+  // are not checked for the routes it selects, and MatchMode,
+  // MethodNotAllowed and HandleOPTIONS have no effect.
+  Matcher Matcher
+
+  // LimitMode controls what happens to requests exceeding the concurrency
+  // limit of a route added through AddLimit. The default, LimitBlock, makes
+  // them wait.
+  LimitMode LimitMode
+
+  // RateLimitByClient makes routes added through AddRateLimit limit each
+  // client, as identified by the host of the request's RemoteAddr, separately
+  // instead of limiting all requests together. Behind a proxy, RemoteAddr is
+  // the proxy's address unless middleware rewrites it.
+  RateLimitByClient bool
+
+  // Recover makes ServeHTTP recover from panics in route functions. The
+  // request is answered by RecoverHandler, or with 500 Internal Server Error
+  // if RecoverHandler is nil. Setting RecoverHandler implies Recover. Panics
+  // with http.ErrAbortHandler are not recovered, so that net/http can abort
+  // the response. Routes with a recover handler of their own, see
+  // Route.Recover, use it instead.
+  Recover        bool
+  RecoverHandler func(http.ResponseWriter, *http.Request, interface{})
+
+  // Observe, if non-nil, is called after each request has been served,
+  // middleware included. It receives the expression of the route that matched,
+  // or "" if none did, the status code of the response and how long serving
+  // it took.
+  Observe func(pattern string, status int, duration time.Duration)
+
+  // MatchRawQuery makes routes match against the request's URI, as returned by
+  // r.URL.RequestURI, instead of its path. The URI holds the escaped path
+  // followed by "?" and the raw query, if any. Query parameters are not
+  // reordered or otherwise normalized, so expressions should tolerate any
+  // order clients may send them in.
+  MatchRawQuery bool
+
+  // PathFunc, if non-nil, returns the string routes match against instead of
+  // the request's path, e.g. r.URL.EscapedPath() to keep escaped slashes
+  // intact. It takes precedence over MatchRawQuery. Any value taken from a
+  // request header, such as X-Forwarded-Path, is controlled by the client
+  // unless a trusted proxy overwrites it, so routing on it must not be relied
+  // on for access control.
+  PathFunc func(*http.Request) string
+
+  // DecodeSubmatches makes ServeHTTP unescape submatches with url.PathUnescape
+  // before passing them to route functions. Requests with malformed escapes
+  // are answered with 400 Bad Request. Since r.URL.Path is already unescaped,
+  // this is meant for use with MatchRawQuery or a PathFunc returning the
+  // escaped path, e.g. to match "/files/(.+)" against /files/a%2Fb and receive
+  // "a/b" as the submatch.
+  DecodeSubmatches bool
+
+  // MaxBodyBytes, if positive, limits the size of request bodies. The body of
+  // every request that matches a route is wrapped with http.MaxBytesReader,
+  // so route functions reading more than MaxBodyBytes get an error.
+  MaxBodyBytes int64
+
+  // MaxPathLen, if positive, limits the length of the string routes match
+  // against, see PathFunc. Requests exceeding it are answered with 414 URI
+  // Too Long without trying any route. The default, 0, means no limit.
+  MaxPathLen int
+
+  // MaxURILen, if positive, limits the length of the request's URI as sent
+  // by the client, query string included. Requests exceeding it are answered
+  // with 414 URI Too Long without trying any route. Unlike MaxPathLen, it
+  // also catches huge query strings; if both are set, both apply.
+  MaxURILen int
+
+  // RedirectTrailingSlash makes ServeHTTP redirect requests that don't match
+  // any route, but would with a trailing slash added to or removed from their
+  // path. GET and HEAD requests are redirected with 301 Moved Permanently,
+  // others with 308 Permanent Redirect. The query string is preserved.
+  RedirectTrailingSlash bool
+
+  // RejectDuplicates makes registering a route with the same expression and
+  // methods as an existing one fail with ErrDuplicateRoute, since the new
+  // route could never match. Add and the other variants that don't return an
+  // error panic instead. Routes added through AddWeighted are not duplicates
+  // of each other, since requests are split between them.
+  RejectDuplicates bool
+
+  // TrustForwardedProto makes routes added through AddScheme take the scheme
+  // from the X-Forwarded-Proto header when present. Only set it behind a
+  // proxy that sets the header, since clients can send it too.
+  TrustForwardedProto bool
+
+  // HostCaseInsensitive makes routes added through AddHost match hosts
+  // case-insensitively, as DNS does, without (?i) in every host expression:
+  // host expressions are compiled with (?i) and hosts are lowercased before
+  // being matched. Only ASCII letters are lowercased and no Unicode
+  // normalization is applied, so internationalized names should be matched
+  // in their punycode form, e.g. xn--bcher-kva.example. Host expressions are
+  // compiled when routes are added, so it should be set before.
+  HostCaseInsensitive bool
+
+  // ErrorHandler, if non-nil, renders the errors returned by functions added
+  // through AddErr. By default they are answered with 500 Internal Server
+  // Error and the error's text.
+  ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+  // CleanPath makes ServeHTTP clean request paths with path.Clean before
+  // matching, so that /users//42 and /users/x/../42 match like /users/42. A
+  // trailing slash is kept. Route functions see the cleaned path. With
+  // RedirectCleanPath also set, GET and HEAD requests for unclean paths are
+  // instead redirected to the cleaned path with 301 Moved Permanently.
+  CleanPath         bool
+  RedirectCleanPath bool
+
+  // CanonicalHost, if non-empty, makes ServeHTTP redirect requests for any
+  // other host to the same URL on CanonicalHost, e.g. from www.example.com to
+  // example.com, before trying any route. GET and HEAD requests are
+  // redirected with 301 Moved Permanently, others with 308 Permanent
+  // Redirect. The scheme is kept, see TrustForwardedProto. Unless
+  // CanonicalHost includes a port, the request's port is ignored when
+  // comparing hosts.
+  CanonicalHost string
+
+  // DisallowedMethods lists methods, e.g. TRACE and CONNECT, that ServeHTTP
+  // answers with 501 Not Implemented without trying any route. Methods are
+  // compared case-insensitively. 501 is used rather than 405 Method Not
+  // Allowed since the methods are refused for every resource, and a 405
+  // response would have to list the allowed ones. A request is refused if
+  // the method it was sent with, the method MethodOverride gives it or the
+  // one MethodFunc returns is disallowed, so that disallowed methods can't be
+  // tunnelled through POST. As with Drain, refused requests don't reach
+  // middleware, but are passed to StartSpan and Observe.
+  DisallowedMethods []string
+
+  // MethodOverride makes ServeHTTP treat POST requests as having the method
+  // given by their X-HTTP-Method-Override header or, if the header is absent,
+  // by the _method field of their form, for clients that can only send GET
+  // and POST. Only PUT, PATCH and DELETE can be given; other values are
+  // ignored. Route functions see the overriding method in r.Method. The form
+  // field is only read from application/x-www-form-urlencoded bodies, which
+  // it consumes, leaving the parsed form in r.PostForm; other bodies, such as
+  // multipart ones, are left alone. With MaxBodyBytes set, no more than
+  // MaxBodyBytes are read for it. Match and Explain don't read the body, and
+  // only honor the header.
+  MethodOverride bool
+
+  // ServerTiming makes ServeHTTP add a Server-Timing header to responses,
+  // e.g. "app;dur=12.3", with the time in milliseconds from receiving the
+  // request until the response's header was written, middleware included.
+  // Since the header must be sent before the body, time spent writing the
+  // body after that is not included; responses that must report it should be
+  // buffered before being written.
+  ServerTiming bool
+
+  // MethodFunc, if non-nil, returns the method routes are matched by instead
+  // of r.Method, including for MethodNotAllowed, HandleOPTIONS and AutoHEAD.
+  // It is called after MethodOverride has been applied, so it takes
+  // precedence over it. Route functions still see r.Method.
+  MethodFunc func(*http.Request) string
+
+  // TrackCoverage makes ServeHTTP count the requests each route serves, see
+  // Coverage.
+  TrackCoverage bool
+
+  // SkipCancelled makes ServeHTTP skip calling the function of the route that
+  // matched a request whose context is already done, e.g. because the client
+  // went away, and write nothing instead. Observe reports such requests with
+  // the status 499. The check is made once, right before the function would
+  // run, so it is only a best-effort saving of work.
+  SkipCancelled bool
+
+  // Rand, if non-nil, is the source of the random choices made among routes
+  // added through AddWeighted, e.g. rand.New(rand.NewSource(1)) to make them
+  // deterministic in tests. Calls to it are serialized. If Rand is nil, the
+  // math/rand package's top-level functions are used.
+  Rand *rand.Rand
+
+  // WrapResponseWriter, if non-nil, wraps the http.ResponseWriter ServeHTTP
+  // receives before ServeHTTP does anything else, e.g. to collect metrics or
+  // buffer responses. The writer it returns is the one the handler's own
+  // wrapper, which records the status and size for Observe and
+  // BytesWritten, writes to, so everything ServeHTTP, middleware and routes
+  // write passes through it. To keep streaming and connection upgrades
+  // working, it should implement http.Flusher and http.Hijacker if the
+  // writer it wraps does.
+  WrapResponseWriter func(http.ResponseWriter, *http.Request) http.ResponseWriter
+
+  // StartSpan, if non-nil, is called for each request once its route has been
+  // selected, e.g. to start a tracing span. It receives the expression of the
+  // route, or "" if none matched, and returns a context derived from the
+  // request's, which middleware and routes see as r.Context(), and a function
+  // that is called with the response's status code once the request has been
+  // served. Either may be nil.
+  StartSpan func(r *http.Request, pattern string) (ctx context.Context, end func(status int))
+
+  draining   atomic.Bool
+  mu         sync.RWMutex
+  routes     []*Route
+  middleware []func(http.Handler) http.Handler
+  // matched is the middleware added through UseMatched.
+  matched  []func(http.Handler) http.Handler
+  finals   []func(http.ResponseWriter, *http.Request, []string)
+  combined *combined
+  // exact maps the paths of routes added through AddLiteral to their indexes.
+  exact    map[string]int
+  prefixes *prefixIndex
 }
 
 // NewRegexpHandler creates a new RegexpHandler.
@@ -38,19 +386,1752 @@ func NewRegexpHandler() *RegexpHandler {
 // Add registers a new regular expression and function pair, or route.  In
 // addition to the typical parameters an http.HandlerFunc receives, the
 // function will receive a slice of all submatches of the expression when
-// matched with a request's path.
-func (h *RegexpHandler) Add(expression string, function func(http.ResponseWriter, *http.Request, []string)) {
-  re := regexp.MustCompile("^" + expression + "$")
-  h.routes = append(h.routes, &route{re, function})
+// matched with a request's path. The returned Route can be used to configure
+// the route further.
+//
+// Add panics if the expression cannot be compiled. Use AddE to handle the
+// error instead.
+func (h *RegexpHandler) Add(expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.add(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  return rt
+}
+
+// AddE is like Add, but returns an error instead of panicking if the
+// expression cannot be compiled. No route is registered in that case.
+func (h *RegexpHandler) AddE(expression string, function func(http.ResponseWriter, *http.Request, []string)) error {
+  _, err := h.add(expression, function)
+  return err
+}
+
+// AddChecked is like AddE, but first checks the compiled expression against
+// sample paths: each of mustMatch must match it and none of mustNotMatch may.
+// Paths are matched as they would be for requests, under the handler's
+// AnchorMode and CaseInsensitive. AddChecked returns an error describing the
+// first violation, and registers no route, if a check fails.
+func (h *RegexpHandler) AddChecked(expression string, mustMatch, mustNotMatch []string, function func(http.ResponseWriter, *http.Request, []string)) (*Route, error) {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    return nil, err
+  }
+  for _, path := range mustMatch {
+    if !rt.re.MatchString(path) {
+      return nil, fmt.Errorf("handler: expression %q does not match %q", expression, path)
+    }
+  }
+  for _, path := range mustNotMatch {
+    if rt.re.MatchString(path) {
+      return nil, fmt.Errorf("handler: expression %q matches %q", expression, path)
+    }
+  }
+  if err := h.register(rt); err != nil {
+    return nil, err
+  }
+  return rt, nil
+}
+
+// AddMethod is like Add, but the route only matches requests whose method
+// equals method. Methods are compared case-insensitively.
+func (h *RegexpHandler) AddMethod(method, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.methods = upper([]string{method})
+  return h.addRoute(rt)
+}
+
+// AddMethods is like AddMethod, but the route matches requests whose method
+// is any of methods. An empty slice means any method, as with Add.
+func (h *RegexpHandler) AddMethods(methods []string, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.methods = upper(methods)
+  return h.addRoute(rt)
+}
+
+// AddHandler is like Add, but registers an http.Handler. The handler can read
+// the submatches through SubmatchesFromContext.
+func (h *RegexpHandler) AddHandler(expression string, handler http.Handler) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    handler.ServeHTTP(w, r)
+  })
+}
+
+// Handle is like AddHandler, but has the signature of http.ServeMux's Handle
+// to ease migrating from it. Unlike ServeMux patterns, expression is a regular
+// expression, and routes are selected in order of registration.
+func (h *RegexpHandler) Handle(expression string, handler http.Handler) {
+  h.AddHandler(expression, handler)
+}
+
+// HandleFunc is like Handle, but registers a function, like http.ServeMux's
+// HandleFunc.
+func (h *RegexpHandler) HandleFunc(expression string, handler func(http.ResponseWriter, *http.Request)) {
+  h.AddHandler(expression, http.HandlerFunc(handler))
+}
+
+// AddNamed is like Add, but the function receives the submatches of named
+// groups, e.g. (?P<id>\d+), as a map from group name to submatch. Unnamed
+// groups are omitted. If several groups share a name, the last one wins.
+func (h *RegexpHandler) AddNamed(expression string, function func(http.ResponseWriter, *http.Request, map[string]string)) *Route {
+  re, err := h.compile(expression)
+  if err != nil {
+    panic(err)
+  }
+  names := re.SubexpNames()[1:]
+  return h.addRoute(&Route{expression: expression, re: re, f: func(w http.ResponseWriter, r *http.Request, m []string) {
+    named := make(map[string]string)
+    for i, name := range names {
+      if name != "" {
+        named[name] = m[i]
+      }
+    }
+    function(w, r, named)
+  }})
+}
+
+// AddIndexed is like Add, but the function receives the path the expression
+// matched against and the start and end offsets of each submatch within it.
+// Unlike with Add, a group that didn't participate in the match, e.g. the
+// optional group of "/x(/y)?" for /x, can be told apart from one that matched
+// the empty string: its offsets are both -1.
+func (h *RegexpHandler) AddIndexed(expression string, function func(w http.ResponseWriter, r *http.Request, matches [][2]int, path string)) *Route {
+  rt, err := h.newRoute(expression, nil)
+  if err != nil {
+    panic(err)
+  }
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    // The route is looked up per request, as a clone may have reanchored it.
+    current := matchFromContext(r)
+    path, re := current.path, current.route.re
+    loc := re.FindStringSubmatchIndex(path)
+    matches := make([][2]int, re.NumSubexp())
+    for i := range matches {
+      if loc != nil {
+        matches[i] = [2]int{loc[2*i+2], loc[2*i+3]}
+      } else {
+        matches[i] = [2]int{-1, -1}
+      }
+    }
+    function(w, r, matches, path)
+  }
+  return h.addRoute(rt)
+}
+
+// AddEscaped is like Add, but the function also receives the submatches of
+// the expression matched separately against r.URL.EscapedPath, so that
+// escapes such as "%2F", which r.URL.Path shows as "/", can be told apart.
+// Submatches are paired by group: raw[i] is the escaped form of m[i]. Since
+// the escaped path is matched independently, its submatches are all "" if
+// the expression doesn't match it, e.g. when a group like "([^/]+)" only
+// matches the unescaped path because the escaped one contains "%2F".
+func (h *RegexpHandler) AddEscaped(expression string, function func(w http.ResponseWriter, r *http.Request, m, raw []string)) *Route {
+  rt, err := h.newRoute(expression, nil)
+  if err != nil {
+    panic(err)
+  }
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    raw := make([]string, len(m))
+    re := matchFromContext(r).route.re
+    if escaped := re.FindStringSubmatch(r.URL.EscapedPath()); escaped != nil {
+      copy(raw, escaped[1:])
+    }
+    function(w, r, m, raw)
+  }
+  return h.addRoute(rt)
+}
+
+// AddErr is like Add, but the function may return an error, which is rendered
+// by ErrorHandler. If the function has already written the response's header
+// when it returns an error, the error is dropped, since a second response
+// can't be written.
+//
+// If the function returns ErrPassThrough without writing, ServeHTTP goes on to
+// the routes registered after this one, as if its expression hadn't matched.
+// The handler's middleware isn't run again, and headers the function set stay
+// set. Passing through is not supported with a Matcher, so the request is
+// then served by NotFound.
+func (h *RegexpHandler) AddErr(expression string, function func(http.ResponseWriter, *http.Request, []string) error) *Route {
+  rt, err := h.newRoute(expression, nil)
+  if err != nil {
+    panic(err)
+  }
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    rw := &responseWriter{ResponseWriter: w}
+    err := function(rw, r, m)
+    if err == nil || rw.written() {
+      return
+    }
+    if errors.Is(err, ErrPassThrough) {
+      matchFromContext(r).passed = true
+      return
+    }
+    // The handler is looked up per request, as a clone has its own.
+    if h := matchFromContext(r).route.h; h.ErrorHandler != nil {
+      h.ErrorHandler(w, r, err)
+    } else {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+  }
+  return h.addRoute(rt)
+}
+
+// AddRecover is like Add, but panics in the function are recovered and
+// answered by recoverFunc, whatever the handler's Recover and RecoverHandler,
+// see Route.Recover.
+func (h *RegexpHandler) AddRecover(expression string, recoverFunc func(w http.ResponseWriter, r *http.Request, v interface{}), function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, function).Recover(recoverFunc)
+}
+
+// AddInt is like Add, but the function receives the submatches converted to
+// integers. If any submatch is not a valid integer, including one that is
+// empty or out of range, the request is answered with 400 Bad Request and the
+// function is not called.
+func (h *RegexpHandler) AddInt(expression string, function func(http.ResponseWriter, *http.Request, []int)) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    ints := make([]int, len(m))
+    for i, s := range m {
+      n, err := strconv.Atoi(s)
+      if err != nil {
+        http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+        return
+      }
+      ints[i] = n
+    }
+    function(w, r, ints)
+  })
+}
+
+// AddContentType is like Add, but sets the Content-Type header of responses
+// to contentType before calling the function, unless it is already set. The
+// function can still set a different Content-Type before writing.
+func (h *RegexpHandler) AddContentType(contentType, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    if w.Header().Get("Content-Type") == "" {
+      w.Header().Set("Content-Type", contentType)
+    }
+    function(w, r, m)
+  })
+}
+
+// AddConsumes is like Add, but requests with a body whose Content-Type isn't
+// mediaType, e.g. "application/json", are answered with 415 Unsupported Media
+// Type without calling the function. Parameters such as charset are ignored,
+// and media types are compared case-insensitively. GET and HEAD requests, and
+// requests without a body, are not checked.
+func (h *RegexpHandler) AddConsumes(mediaType, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Body != nil && r.Body != http.NoBody {
+      got, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+      if err != nil || !strings.EqualFold(got, mediaType) {
+        http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+        return
+      }
+    }
+    function(w, r, m)
+  })
+}
+
+// AddHost is like Add, but the route only matches requests whose host also
+// matches hostExpression. The host is matched without its port, so
+// "example.com" matches requests to both example.com and example.com:8080.
+// The host expression always has to match the entire host, whatever the
+// handler's AnchorMode.
+func (h *RegexpHandler) AddHost(hostExpression, pathExpression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  host, err := h.compileHost(hostExpression)
+  if err != nil {
+    panic(err)
+  }
+  re, err := h.compile(pathExpression)
+  if err != nil {
+    panic(err)
+  }
+  return h.addRoute(&Route{expression: pathExpression, re: re, host: host, hostLower: h.HostCaseInsensitive, f: function})
+}
+
+// AddQuery is like Add, but the route only matches requests whose query
+// contains each of params. A parameter with an empty value only needs to be
+// present; otherwise one of its values must equal the given value. Query
+// parameters not mentioned in params are ignored.
+func (h *RegexpHandler) AddQuery(expression string, params map[string]string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  required := make(map[string]string, len(params))
+  for key, value := range params {
+    required[key] = value
+  }
+  rt.conditions = append(rt.conditions, func(_ *Route, r *http.Request) bool {
+    query := r.URL.Query()
+    for key, value := range required {
+      values, ok := query[key]
+      if !ok || value != "" && !contains(values, value) {
+        return false
+      }
+    }
+    return true
+  })
+  return h.addRoute(rt)
+}
+
+// AddIf is like Add, but the route only matches requests while enabled
+// returns true, e.g. to put a route behind a feature flag. enabled is called
+// for each request whose path matches the expression, so flags can change at
+// run time; while it returns false, the route is skipped as if its expression
+// didn't match, and later routes can serve the request. It must be safe for
+// concurrent use.
+func (h *RegexpHandler) AddIf(enabled func() bool, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.conditions = append(rt.conditions, func(_ *Route, r *http.Request) bool {
+    return enabled()
+  })
+  return h.addRoute(rt)
+}
+
+// AddScheme is like Add, but the route only matches requests made with scheme,
+// "http" or "https". A request is taken to be https if it arrived over TLS or,
+// with TrustForwardedProto set, if its X-Forwarded-Proto header says so.
+func (h *RegexpHandler) AddScheme(scheme, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.conditions = append(rt.conditions, func(rt *Route, r *http.Request) bool {
+    return strings.EqualFold(rt.h.scheme(r), scheme)
+  })
+  return h.addRoute(rt)
+}
+
+// AddPort is like Add, but the route only matches requests whose host, as
+// given by r.Host, has the given port. Hosts without a port are taken to have
+// the default port of the request's scheme, see AddScheme: 80 for http and
+// 443 for https.
+func (h *RegexpHandler) AddPort(port, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.conditions = append(rt.conditions, func(rt *Route, r *http.Request) bool {
+    return rt.h.port(r) == port
+  })
+  return h.addRoute(rt)
+}
+
+// port returns the port of a request's host.
+func (h *RegexpHandler) port(r *http.Request) string {
+  if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+    return port
+  }
+  if h.scheme(r) == "https" {
+    return "443"
+  }
+  return "80"
+}
+
+// scheme returns the scheme a request was made with.
+func (h *RegexpHandler) scheme(r *http.Request) string {
+  if h.TrustForwardedProto {
+    if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+      proto, _, _ = strings.Cut(proto, ",")
+      return strings.ToLower(strings.TrimSpace(proto))
+    }
+  }
+  if r.TLS != nil {
+    return "https"
+  }
+  return "http"
+}
+
+// contains reports whether values contains value.
+func contains(values []string, value string) bool {
+  for _, v := range values {
+    if v == value {
+      return true
+    }
+  }
+  return false
+}
+
+// AddTimeout is like Add, but responds with 503 Service Unavailable if the
+// function doesn't return within d. Writes made by the function are buffered
+// and discarded after the timeout, so the response is never written twice.
+// The function itself isn't stopped and may keep running, but the context of
+// its request, a child of the original request's context, is canceled when
+// the timeout expires, so functions that watch r.Context().Done() can return
+// early.
+func (h *RegexpHandler) AddTimeout(expression string, d time.Duration, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    f := func(w http.ResponseWriter, r *http.Request) {
+      function(w, r, m)
+    }
+    http.TimeoutHandler(http.HandlerFunc(f), d, http.StatusText(http.StatusServiceUnavailable)).ServeHTTP(w, r)
+  })
+}
+
+// Mount delegates requests whose path starts with prefix to sub. The prefix is
+// matched literally and removed from the path sub sees. A request is only
+// delegated if the stripped path matches one of sub's routes; otherwise the
+// routes registered after the mount are tried. If sub's NotFound is set, every
+// request under the prefix is delegated, and sub's NotFound rather than the
+// handler's serves those no route of sub matches. Functions of sub's routes
+// can get the path before stripping with OriginalPath.
+func (h *RegexpHandler) Mount(prefix string, sub *RegexpHandler) *Route {
+  expression := regexp.QuoteMeta(prefix) + "(?s:.*)"
+  return h.addRoute(&Route{
+    expression: expression,
+    re:         regexp.MustCompile("^" + expression + "$"),
+    verbatim:   true,
+    prefix:     prefix,
+    sub:        sub,
+    f: func(w http.ResponseWriter, r *http.Request, m []string) {
+      if _, ok := r.Context().Value(originalPathKey{}).(string); !ok {
+        r = r.WithContext(context.WithValue(r.Context(), originalPathKey{}, r.URL.Path))
+      }
+      sub.ServeHTTP(w, stripPrefix(r, prefix))
+    },
+  })
+}
+
+// AddRoot registers a route that matches the root path "/" only, whatever
+// the handler's AnchorMode. It also matches the empty path, which requests
+// rewritten by proxies that strip a prefix, or created without a path, may
+// have. The function receives no submatches. With MatchRawQuery, the route
+// only matches requests without a query, since the query is part of what
+// routes match against.
+func (h *RegexpHandler) AddRoot(function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.addRoute(&Route{
+    expression: "/?",
+    re:         regexp.MustCompile("^/?$"),
+    verbatim:   true,
+    f:          function,
+  })
+}
+
+// AddPrefix registers a route that matches paths starting with prefix, which
+// is matched literally. The function receives the rest of the path after the
+// prefix, which may be empty. Like r.URL.Path, the rest is unescaped; when
+// routes match against the escaped path, see MatchRawQuery and PathFunc, set
+// DecodeSubmatches to unescape it. Requests whose rest contains a ".."
+// element are answered with 400 Bad Request, so that the rest can safely be
+// used as a relative file name.
+func (h *RegexpHandler) AddPrefix(prefix string, function func(w http.ResponseWriter, r *http.Request, rest string)) *Route {
+  expression := regexp.QuoteMeta(prefix) + "(?s:(.*))"
+  return h.addRoute(&Route{
+    expression: expression,
+    re:         regexp.MustCompile("^" + expression + "$"),
+    verbatim:   true,
+    f: func(w http.ResponseWriter, r *http.Request, m []string) {
+      if containsDotDot(m[0]) {
+        http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+        return
+      }
+      function(w, r, m[0])
+    },
+  })
+}
+
+// AddLocalePrefix is like Add, but the path may start with a segment naming
+// one of locales, as in /fr/about, which is stripped before the rest of the
+// path is matched against expression. The function receives the locale, or ""
+// if the path doesn't start with one, the request with the locale segment
+// removed from its path, and the submatches of expression. A locale must make
+// up the whole segment, so with the locale "en", /enterprise is matched
+// against expression as it is, as are paths starting with other segments.
+func (h *RegexpHandler) AddLocalePrefix(locales []string, expression string, function func(w http.ResponseWriter, r *http.Request, locale string, m []string)) *Route {
+  var quoted []string
+  for _, locale := range locales {
+    if locale != "" {
+      quoted = append(quoted, regexp.QuoteMeta(locale))
+    }
+  }
+  // Longer locales come first, so that "en-GB" is preferred to "en".
+  sort.SliceStable(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+  prefix := "()"
+  if len(quoted) > 0 {
+    prefix = "(?:/(" + strings.Join(quoted, "|") + "))?"
+  }
+  rt, err := h.newRoute(prefix+"(?:"+expression+")", nil)
+  if err != nil {
+    panic(err)
+  }
+  bare, err := h.compile(expression)
+  if err != nil {
+    panic(err)
+  }
+  // bares maps each compiled form of the route to expression compiled on its
+  // own with the same settings, since Reanchor recompiles the route, in a
+  // clone possibly with other settings than the original's.
+  var mu sync.Mutex
+  bares := map[*regexp.Regexp]*regexp.Regexp{rt.re: bare}
+  // split returns the locale of path and the submatches of expression.
+  // Regular expressions can't look ahead, so a locale ending inside a
+  // segment is only ruled out after matching, by matching path against
+  // expression on its own.
+  split := func(rt *Route, path string) (string, []string, bool) {
+    loc := rt.re.FindStringSubmatchIndex(path)
+    if loc == nil {
+      return "", nil, false
+    }
+    if loc[2] < 0 {
+      return "", submatchesAt(path, loc[4:]), true
+    }
+    if end := loc[3]; end == len(path) || path[end] == '/' {
+      return path[loc[2]:end], submatchesAt(path, loc[4:]), true
+    }
+    mu.Lock()
+    bare := bares[rt.re]
+    if bare == nil {
+      var err error
+      if bare, err = rt.h.compile(expression); err != nil {
+        mu.Unlock()
+        return "", nil, false
+      }
+      bares[rt.re] = bare
+    }
+    mu.Unlock()
+    m := bare.FindStringSubmatch(path)
+    if m == nil {
+      return "", nil, false
+    }
+    return "", m[1:], true
+  }
+  rt.conditions = append(rt.conditions, func(rt *Route, r *http.Request) bool {
+    _, _, ok := split(rt, rt.h.path(r))
+    return ok
+  })
+  rt.f = func(w http.ResponseWriter, r *http.Request, m []string) {
+    current := matchFromContext(r)
+    locale, m, _ := split(current.route, current.path)
+    if locale != "" {
+      r = stripPrefix(r, "/"+locale)
+    }
+    function(w, r, locale, m)
+  }
+  return h.addRoute(rt)
+}
+
+// submatchesAt returns the substrings of s at the pairs of indexes of loc, as
+// returned by FindStringSubmatchIndex, with "" for groups that didn't match.
+func submatchesAt(s string, loc []int) []string {
+  m := make([]string, len(loc)/2)
+  for i := range m {
+    if loc[2*i] >= 0 {
+      m[i] = s[loc[2*i]:loc[2*i+1]]
+    }
+  }
+  return m
+}
+
+// stripPrefix returns a shallow copy of r with prefix removed from its path.
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+  r2 := new(http.Request)
+  *r2 = *r
+  r2.URL = new(url.URL)
+  *r2.URL = *r.URL
+  r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+  r2.URL.RawPath = ""
+  return r2
+}
+
+// AddLimit is like Add, but at most maxConcurrent calls of the function run at
+// the same time. What happens to requests beyond that depends on the
+// handler's LimitMode. AddLimit panics if maxConcurrent is not positive.
+func (h *RegexpHandler) AddLimit(expression string, maxConcurrent int, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  if maxConcurrent <= 0 {
+    panic(fmt.Errorf("handler: invalid concurrency limit %d", maxConcurrent))
+  }
+  sem := make(chan struct{}, maxConcurrent)
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    // The mode is looked up per request, as a clone has its own.
+    if matchFromContext(r).route.h.LimitMode == LimitReject {
+      select {
+      case sem <- struct{}{}:
+      default:
+        http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+        return
+      }
+    } else {
+      select {
+      case sem <- struct{}{}:
+      case <-r.Context().Done():
+        return
+      }
+    }
+    defer func() { <-sem }()
+    function(w, r, m)
+  })
+}
+
+// AddHeaderLimit is like Add, but requests with more than maxHeaders header
+// values are answered with 431 Request Header Fields Too Large without calling
+// the function. Each value of a header counts separately, so a header sent
+// twice counts twice.
+func (h *RegexpHandler) AddHeaderLimit(expression string, maxHeaders int, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    n := 0
+    for _, values := range r.Header {
+      n += len(values)
+    }
+    if n > maxHeaders {
+      http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+      return
+    }
+    function(w, r, m)
+  })
+}
+
+// WithRouteTimeout wraps a route function so that it's called with a request
+// whose context is canceled after d, or when the original request's context
+// is. Unlike AddTimeout, the function runs on the calling goroutine and its
+// writes aren't buffered, so no response is sent on its behalf when the
+// timeout expires; the function is expected to watch r.Context().Done() and
+// return early.
+func WithRouteTimeout(d time.Duration, function func(http.ResponseWriter, *http.Request, []string)) func(http.ResponseWriter, *http.Request, []string) {
+  return func(w http.ResponseWriter, r *http.Request, m []string) {
+    ctx, cancel := context.WithTimeout(r.Context(), d)
+    defer cancel()
+    function(w, r.WithContext(ctx), m)
+  }
+}
+
+// AddRegexp is like Add, but registers an already compiled regular
+// expression. The expression is used verbatim; unlike Add, it is not anchored
+// to match the entire path, so the caller is responsible for including "^"
+// and "$" where needed.
+func (h *RegexpHandler) AddRegexp(re *regexp.Regexp, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.addRoute(&Route{expression: re.String(), re: re, verbatim: true, f: function})
+}
+
+// AddRaw is like AddE, but the pattern is not anchored, whatever the
+// handler's AnchorMode, so it matches anywhere in the path unless it contains
+// "^" or "$" itself. Unlike AddRegexp, it takes the pattern as a string, which
+// CaseInsensitive applies to, and returns an error if it cannot be compiled.
+func (h *RegexpHandler) AddRaw(pattern string, function func(http.ResponseWriter, *http.Request, []string)) (*Route, error) {
+  compiled := pattern
+  if h.CaseInsensitive {
+    compiled = "(?i)" + pattern
+  }
+  re, err := regexp.Compile(compiled)
+  if err != nil {
+    return nil, err
+  }
+  rt := &Route{expression: pattern, re: re, verbatim: true, f: function}
+  if err := h.register(rt); err != nil {
+    return nil, err
+  }
+  return rt, nil
+}
+
+func (h *RegexpHandler) add(expression string, function func(http.ResponseWriter, *http.Request, []string)) (*Route, error) {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    return nil, err
+  }
+  if err := h.register(rt); err != nil {
+    return nil, err
+  }
+  return rt, nil
+}
+
+// newRoute compiles an expression into a route without registering it.
+func (h *RegexpHandler) newRoute(expression string, function func(http.ResponseWriter, *http.Request, []string)) (*Route, error) {
+  re, err := h.compile(expression)
+  if err != nil {
+    return nil, err
+  }
+  return &Route{h: h, expression: expression, re: re, literals: literals(re), literalPrefix: literalPrefix(re), f: function}, nil
+}
+
+// RouteSpec describes a route to register with AddAll.
+type RouteSpec struct {
+  // Expression is the route's expression, as given to Add.
+  Expression string
+  // Method, if non-empty, restricts the route to a method, as with
+  // AddMethod.
+  Method string
+  Func   func(http.ResponseWriter, *http.Request, []string)
+}
+
+// AddAll registers a route for each spec, in order. If any spec's expression
+// cannot be compiled, AddAll returns an error naming its index and registers
+// none of the routes. The same applies to duplicates if RejectDuplicates is
+// set.
+func (h *RegexpHandler) AddAll(specs []RouteSpec) error {
+  routes, err := h.newRoutes(specs)
+  if err != nil {
+    return err
+  }
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for i, rt := range routes {
+    if h.duplicate(rt, h.routes) || h.duplicate(rt, routes[:i]) {
+      return fmt.Errorf("handler: route %d: %w", i, ErrDuplicateRoute)
+    }
+  }
+  h.routes = append(h.routes, routes...)
+  h.routesChanged()
+  return nil
+}
+
+// ReplaceRoutes is like AddAll, but replaces all registered routes with those
+// of specs at once, so that no request is matched against a partial set of
+// routes. If any spec is invalid, ReplaceRoutes returns an error and the
+// registered routes are left as they are.
+func (h *RegexpHandler) ReplaceRoutes(specs []RouteSpec) error {
+  routes, err := h.newRoutes(specs)
+  if err != nil {
+    return err
+  }
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for i, rt := range routes {
+    if h.duplicate(rt, routes[:i]) {
+      return fmt.Errorf("handler: route %d: %w", i, ErrDuplicateRoute)
+    }
+  }
+  h.routes = routes
+  h.routesChanged()
+  return nil
+}
+
+// newRoutes compiles specs into routes without registering them.
+func (h *RegexpHandler) newRoutes(specs []RouteSpec) ([]*Route, error) {
+  routes := make([]*Route, len(specs))
+  for i, spec := range specs {
+    rt, err := h.newRoute(spec.Expression, spec.Func)
+    if err != nil {
+      return nil, fmt.Errorf("handler: route %d: %w", i, err)
+    }
+    if spec.Method != "" {
+      rt.methods = upper([]string{spec.Method})
+    }
+    routes[i] = rt
+  }
+  return routes, nil
+}
+
+// AddFinal registers a function that serves requests that don't match any
+// route. Final functions are only called after every route has been tried,
+// regardless of the order in which they were registered relative to routes.
+// They receive an empty slice of submatches and are called in the order they
+// were registered until one of them writes a response. If none does, the
+// request is served by NotFound.
+func (h *RegexpHandler) AddFinal(function func(http.ResponseWriter, *http.Request, []string)) {
+  h.mu.Lock()
+  h.finals = append(h.finals, function)
+  h.mu.Unlock()
+}
+
+// Remove unregisters the first route that was added with expression, as given
+// to Add, and reports whether one was found. The remaining routes keep their
+// order of precedence.
+func (h *RegexpHandler) Remove(expression string) bool {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for i, rt := range h.routes {
+    if rt.expression == expression {
+      routes := make([]*Route, 0, len(h.routes)-1)
+      routes = append(routes, h.routes[:i]...)
+      h.routes = append(routes, h.routes[i+1:]...)
+      h.routesChanged()
+      return true
+    }
+  }
+  return false
+}
+
+// Insert is like AddE, but registers the route at index in the order of
+// precedence instead of last, shifting later routes down. It returns an error
+// if index is out of range, i.e. negative or greater than the number of
+// routes.
+func (h *RegexpHandler) Insert(index int, expression string, function func(http.ResponseWriter, *http.Request, []string)) error {
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    return err
+  }
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if index < 0 || index > len(h.routes) {
+    return fmt.Errorf("handler: index %d out of range [0, %d]", index, len(h.routes))
+  }
+  if h.duplicate(rt, h.routes) {
+    return ErrDuplicateRoute
+  }
+  routes := make([]*Route, 0, len(h.routes)+1)
+  routes = append(routes, h.routes[:index]...)
+  routes = append(routes, rt)
+  h.routes = append(routes, h.routes[index:]...)
+  h.routesChanged()
+  return nil
+}
+
+// AddFront is like AddE, but registers the route first in the order of
+// precedence.
+func (h *RegexpHandler) AddFront(expression string, function func(http.ResponseWriter, *http.Request, []string)) error {
+  return h.Insert(0, expression, function)
+}
+
+// MoveToFront moves the first route that was added with expression to the
+// front of the order of precedence, and reports whether one was found. The
+// other routes keep their relative order.
+func (h *RegexpHandler) MoveToFront(expression string) bool {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for i, rt := range h.routes {
+    if rt.expression == expression {
+      routes := make([]*Route, 0, len(h.routes))
+      routes = append(routes, rt)
+      routes = append(routes, h.routes[:i]...)
+      h.routes = append(routes, h.routes[i+1:]...)
+      h.routesChanged()
+      return true
+    }
+  }
+  return false
+}
+
+// Swap exchanges the routes at indexes i and j in the order of precedence. It
+// returns an error if either index is out of range.
+func (h *RegexpHandler) Swap(i, j int) error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for _, index := range []int{i, j} {
+    if index < 0 || index >= len(h.routes) {
+      return fmt.Errorf("handler: index %d out of range [0, %d)", index, len(h.routes))
+    }
+  }
+  routes := append([]*Route(nil), h.routes...)
+  routes[i], routes[j] = routes[j], routes[i]
+  h.routes = routes
+  h.routesChanged()
+  return nil
+}
+
+// Clone returns a copy of the handler, its configuration and its routes.
+// Routes added to or removed from the copy don't affect the original, and vice
+// versa. Compiled expressions, route functions and middleware are shared.
+func (h *RegexpHandler) Clone() *RegexpHandler {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  c := &RegexpHandler{
+    MethodNotAllowed:      h.MethodNotAllowed,
+    HandleOPTIONS:         h.HandleOPTIONS,
+    AutoHEAD:              h.AutoHEAD,
+    NotFound:              h.NotFound,
+    WriteNotFound:         h.WriteNotFound,
+    CaseInsensitive:       h.CaseInsensitive,
+    AnchorMode:            h.AnchorMode,
+    TolerateLeadingSlash:  h.TolerateLeadingSlash,
+    MatchMode:             h.MatchMode,
+    Matcher:               h.Matcher,
+    LimitMode:             h.LimitMode,
+    RateLimitByClient:     h.RateLimitByClient,
+    Recover:               h.Recover,
+    RecoverHandler:        h.RecoverHandler,
+    Observe:               h.Observe,
+    MatchRawQuery:         h.MatchRawQuery,
+    PathFunc:              h.PathFunc,
+    DecodeSubmatches:      h.DecodeSubmatches,
+    MaxBodyBytes:          h.MaxBodyBytes,
+    MaxPathLen:            h.MaxPathLen,
+    MaxURILen:             h.MaxURILen,
+    RedirectTrailingSlash: h.RedirectTrailingSlash,
+    RejectDuplicates:      h.RejectDuplicates,
+    TrustForwardedProto:   h.TrustForwardedProto,
+    HostCaseInsensitive:   h.HostCaseInsensitive,
+    ErrorHandler:          h.ErrorHandler,
+    CleanPath:             h.CleanPath,
+    RedirectCleanPath:     h.RedirectCleanPath,
+    CanonicalHost:         h.CanonicalHost,
+    DisallowedMethods:     append([]string(nil), h.DisallowedMethods...),
+    MethodOverride:        h.MethodOverride,
+    ServerTiming:          h.ServerTiming,
+    SkipCancelled:         h.SkipCancelled,
+    Rand:                  h.Rand,
+    WrapResponseWriter:    h.WrapResponseWriter,
+    StartSpan:             h.StartSpan,
+    MethodFunc:            h.MethodFunc,
+    TrackCoverage:         h.TrackCoverage,
+    combined:              h.combined,
+    exact:                 h.exact,
+    prefixes:              h.prefixes,
+  }
+  c.middleware = append(c.middleware, h.middleware...)
+  c.matched = append(c.matched, h.matched...)
+  c.finals = append(c.finals, h.finals...)
+  c.routes = make([]*Route, len(h.routes))
+  for i, rt := range h.routes {
+    copied := *rt
+    copied.h = c
+    copied.hits = 0
+    copied.methods = append([]string(nil), rt.methods...)
+    copied.middleware = append([]func(http.Handler) http.Handler(nil), rt.middleware...)
+    c.routes[i] = &copied
+  }
+  return c
+}
+
+// Routes returns a description of every registered route in order of
+// precedence.
+func (h *RegexpHandler) Routes() []RouteInfo {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  infos := make([]RouteInfo, len(h.routes))
+  for i, rt := range h.routes {
+    infos[i] = RouteInfo{Expression: rt.expression, Method: strings.Join(rt.methods, ", ")}
+  }
+  return infos
+}
+
+// Len returns the number of registered routes.
+func (h *RegexpHandler) Len() int {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  return len(h.routes)
+}
+
+// Stats returns a summary of the registered routes.
+func (h *RegexpHandler) Stats() RouteStats {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  stats := RouteStats{Routes: len(h.routes), ByMethod: make(map[string]int)}
+  for _, rt := range h.routes {
+    if len(rt.methods) == 0 {
+      stats.ByMethod[""]++
+    }
+    for _, m := range rt.methods {
+      stats.ByMethod[strings.ToUpper(m)]++
+    }
+    if rt.name != "" {
+      stats.Named++
+    }
+  }
+  return stats
+}
+
+// Coverage returns the number of requests served by the routes with each
+// expression while TrackCoverage was set. Routes that never matched, e.g.
+// because an earlier route shadows them, are included with a count of 0.
+func (h *RegexpHandler) Coverage() map[string]int {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  coverage := make(map[string]int, len(h.routes))
+  for _, rt := range h.routes {
+    coverage[rt.expression] += int(atomic.LoadInt64(&rt.hits))
+  }
+  return coverage
+}
+
+// addRoute is like register, but panics on error and returns the route.
+func (h *RegexpHandler) addRoute(rt *Route) *Route {
+  if err := h.register(rt); err != nil {
+    panic(err)
+  }
+  return rt
+}
+
+// register appends a route to the handler's routes. Existing elements of the
+// routes slice are never modified in place, so a snapshot of it stays valid
+// after the lock is released.
+func (h *RegexpHandler) register(rt *Route) error {
+  rt.h = h
+  rt.literals = literals(rt.re)
+  rt.literalPrefix = literalPrefix(rt.re)
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if h.duplicate(rt, h.routes) {
+    return ErrDuplicateRoute
+  }
+  h.routes = append(h.routes, rt)
+  h.routesChanged()
+  return nil
+}
+
+// routesChanged discards what was derived from the previous routes. It must
+// be called with the handler's lock held whenever the routes change.
+func (h *RegexpHandler) routesChanged() {
+  h.combined = nil
+  h.exact = exactIndex(h.routes)
+  h.prefixes = newPrefixIndex(h.routes)
+}
+
+// duplicate reports whether RejectDuplicates is set and one of routes has the
+// same expression and methods as rt, unless both are weighted.
+func (h *RegexpHandler) duplicate(rt *Route, routes []*Route) bool {
+  if !h.RejectDuplicates {
+    return false
+  }
+  for _, other := range routes {
+    if rt.weight > 0 && other.weight > 0 {
+      continue
+    }
+    if other.expression == rt.expression && sameMethods(other.methods, rt.methods) {
+      return true
+    }
+  }
+  return false
+}
+
+// sameMethods reports whether two sets of methods are equal, ignoring case.
+func sameMethods(a, b []string) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for _, m := range a {
+    found := false
+    for _, n := range b {
+      if strings.EqualFold(m, n) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false
+    }
+  }
+  return true
+}
+
+// Compile combines the expressions of all registered routes into a single
+// regular expression, so that ServeHTTP can find the matching route with one
+// search instead of trying each route's expression in turn. Precedence is
+// unaffected.
+//
+// Whether this pays off depends on the routes: Go's regexp package runs a
+// large alternation little faster than its parts, while the linear scan skips
+// most routes with a cheap check of their literal prefix. For 200 routes with
+// distinct prefixes, the linear scan is faster; see BenchmarkLinear200 and
+// BenchmarkCombined200 and measure with your own routes before relying on
+// Compile.
+//
+// Adding or removing routes discards the combined expression, so Compile
+// should be called again once all routes are registered.
+func (h *RegexpHandler) Compile() error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  c, err := newCombined(h.routes)
+  if err != nil {
+    return err
+  }
+  h.combined = c
+  return nil
+}
+
+// Reanchor recompiles the expressions of the registered routes according to
+// the current AnchorMode and CaseInsensitive, which otherwise only apply to
+// routes added after they are changed. Routes whose expressions are used
+// verbatim, such as those added through AddRegexp, AddRaw, AddLiteral,
+// AddPrefix and Mount, and the host expressions of AddHost, are left as they
+// are. Every expression is compiled again, so Reanchor is meant to be called
+// once while setting up the handler, before it serves requests. If an
+// expression fails to compile, Reanchor returns the error and changes no
+// route.
+func (h *RegexpHandler) Reanchor() error {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  res := make([]*regexp.Regexp, len(h.routes))
+  for i, rt := range h.routes {
+    if rt.verbatim {
+      continue
+    }
+    re, err := h.compile(rt.expression)
+    if err != nil {
+      return err
+    }
+    if rt.longest {
+      re.Longest()
+    }
+    res[i] = re
+  }
+  for i, rt := range h.routes {
+    if res[i] != nil {
+      rt.re = res[i]
+      rt.literals = literals(rt.re)
+      rt.literalPrefix = literalPrefix(rt.re)
+    }
+  }
+  h.routesChanged()
+  return nil
+}
+
+// NotFoundHandler responds to a request with 404 Not Found. It can be
+// registered as a catch-all route:
+//
+//   h.Add(".*", handler.NotFoundHandler)
+func NotFoundHandler(w http.ResponseWriter, r *http.Request, m []string) {
+  http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+}
+
+// MethodNotAllowedHandler responds to a request with 405 Method Not Allowed.
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request, m []string) {
+  http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// Valid reports whether an expression can be compiled the way Add compiles it
+// with the default settings, i.e. anchored at the start and end. It returns
+// the compilation error, if any.
+func Valid(expression string) error {
+  _, err := new(RegexpHandler).compile(expression)
+  return err
+}
+
+// compileHost compiles a host expression. Unlike path expressions, host
+// expressions always have to match the entire host, whatever the handler's
+// AnchorMode and TolerateLeadingSlash, so that e.g. "example\\.com" doesn't
+// match example.com.evil.net.
+func (h *RegexpHandler) compileHost(expression string) (*regexp.Regexp, error) {
+  if h.CaseInsensitive || h.HostCaseInsensitive {
+    expression = "(?i)" + expression
+  }
+  return regexp.Compile("^(?:" + expression + ")$")
+}
+
+// compile compiles an expression anchored according to the handler's
+// AnchorMode.
+func (h *RegexpHandler) compile(expression string) (*regexp.Regexp, error) {
+  start := "^"
+  if h.TolerateLeadingSlash && (h.AnchorMode == AnchorBoth || h.AnchorMode == AnchorStart) {
+    start = "^/?"
+    expression = strings.TrimPrefix(expression, "/")
+  }
+  if h.CaseInsensitive {
+    expression = "(?i)" + expression
+  }
+  switch h.AnchorMode {
+  case AnchorStart:
+    expression = start + expression
+  case AnchorEnd:
+    expression += "$"
+  case AnchorNone:
+  default:
+    expression = start + expression + "$"
+  }
+  return regexp.Compile(expression)
+}
+
+// Use appends a middleware to the handler. Middleware wraps every request
+// ServeHTTP receives, whether or not it matches a route, and runs in the order
+// it was added, the first being outermost. The matching route is selected
+// before any middleware runs, so middleware can read its submatches through
+// SubmatchesFromContext.
+//
+// Each middleware receives the next handler in the chain, the innermost being
+// the route's function. Middleware that responds without calling the next
+// handler, e.g. with 401 Unauthorized, stops dispatch: the route's function is
+// not called.
+func (h *RegexpHandler) Use(middleware func(http.Handler) http.Handler) {
+  h.mu.Lock()
+  h.middleware = append(h.middleware, middleware)
+  h.mu.Unlock()
+}
+
+// UseMatched is like Use, but the middleware only wraps requests that match a
+// route, e.g. to collect metrics by MatchedPattern. It runs after all the
+// middleware added through Use, in the order it was added, and before the
+// middleware of the route's group and of the route itself. Requests that no
+// route serves, including those answered with 404 Not Found, 405 Method Not
+// Allowed or a redirect, skip it.
+func (h *RegexpHandler) UseMatched(middleware func(http.Handler) http.Handler) {
+  h.mu.Lock()
+  h.matched = append(h.matched, middleware)
+  h.mu.Unlock()
 }
 
 // ServeHTTP serves a request by calling the function of the first registered
-// route containing an expression the request's path matches.
+// route containing an expression the request's path matches. Routes restricted
+// to other methods are skipped.
+//
+// The writers ServeHTTP wraps the http.ResponseWriter in implement
+// http.Flusher, so that route functions can stream responses such as
+// server-sent events. Flushing does nothing if the server's writer isn't an
+// http.Flusher. Routes added through AddTimeout or AddCache can't stream,
+// since their responses are buffered.
 func (h *RegexpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  for _, route := range h.routes {
-    if matches := route.re.FindStringSubmatch(r.URL.Path); matches != nil {
-      route.f(w, r, matches[1:])
+  h.serve(w, r)
+}
+
+// serve is ServeHTTP, returning the match it served the request with. For
+// requests refused before matching, the match has no route.
+func (h *RegexpHandler) serve(w http.ResponseWriter, r *http.Request) *match {
+  received := time.Now()
+  if h.WrapResponseWriter != nil {
+    w = h.WrapResponseWriter(w, r)
+  }
+  var m *match
+  var handler http.Handler
+  var redirect string
+  status := 0
+  if h.draining.Load() {
+    status = http.StatusServiceUnavailable
+  } else {
+    sent := r.Method
+    r, redirect = h.cleanPath(h.overrideMethod(r, true))
+    status = h.disallowedStatus(r, sent)
+  }
+  if status != 0 {
+    // Rejected requests skip routing and middleware, but are still observed.
+    m = &match{path: r.URL.Path}
+    handler = rejection(status)
+  } else {
+    if location := h.canonicalHostRedirect(r); location != "" {
+      redirect = location
+    }
+    h.mu.RLock()
+    if redirect != "" {
+      m = &match{path: r.URL.Path, redirect: redirect}
+    } else {
+      m = h.match(h.routes, h.combined, r)
+    }
+    middleware := h.middleware
+    h.mu.RUnlock()
+    if h.TrackCoverage && m.route != nil {
+      atomic.AddInt64(&m.route.hits, 1)
+    }
+
+    handler = dispatcher{h}
+    for i := len(middleware) - 1; i >= 0; i-- {
+      handler = middleware[i](handler)
+    }
+  }
+  m.rw = responseWriter{ResponseWriter: w}
+  rw := &m.rw
+  m.writer, m.start = rw, received
+  r = r.WithContext(context.WithValue(r.Context(), matchKey{}, m))
+  w = rw
+  if h.ServerTiming {
+    tw := &timingWriter{responseWriter: responseWriter{ResponseWriter: rw}, start: received}
+    defer tw.setTiming()
+    w = tw
+  }
+  if h.StartSpan != nil {
+    var pattern string
+    if m.route != nil {
+      pattern = m.route.expression
+    }
+    ctx, end := h.StartSpan(r, pattern)
+    if ctx != nil {
+      r = r.WithContext(ctx)
+    }
+    if end != nil {
+      defer func() { end(rw.Status()) }()
+    }
+  }
+  if h.Observe == nil {
+    handler.ServeHTTP(w, r)
+    return m
+  }
+  start := time.Now()
+  handler.ServeHTTP(w, r)
+  var pattern string
+  if m.route != nil {
+    pattern = m.route.expression
+  }
+  h.Observe(pattern, rw.Status(), time.Since(start))
+  return m
+}
+
+// Dispatch serves a request with the given method, path and body, which may
+// be nil, through ServeHTTP, middleware included, and returns the recorded
+// response. It reports whether a route matched the request. It is meant for
+// tests of route tables. The path may include a query string; like
+// httptest.NewRequest, Dispatch panics if it is invalid.
+func (h *RegexpHandler) Dispatch(method, path string, body io.Reader) (*httptest.ResponseRecorder, bool) {
+  rec := httptest.NewRecorder()
+  m := h.serve(rec, httptest.NewRequest(method, path, body))
+  return rec, m.route != nil
+}
+
+// drainRetryAfter is the Retry-After header sent while the handler is
+// draining, in seconds.
+const drainRetryAfter = "5"
+
+// Drain makes the handler stop serving new requests, e.g. while the server is
+// shutting down. Subsequent requests are answered with 503 Service
+// Unavailable and a Retry-After header, while requests already being served
+// complete normally. Refused requests don't reach middleware, but are passed
+// to StartSpan and Observe with an empty pattern.
+func (h *RegexpHandler) Drain() {
+  h.draining.Store(true)
+}
+
+// disallowedStatus returns 501 Not Implemented if the method a request was
+// sent with, or the method it has after MethodOverride or the one MethodFunc
+// returns for it, is one of DisallowedMethods, and 0 otherwise.
+func (h *RegexpHandler) disallowedStatus(r *http.Request, sent string) int {
+  if len(h.DisallowedMethods) == 0 {
+    return 0
+  }
+  effective := h.method(r)
+  for _, method := range h.DisallowedMethods {
+    if strings.EqualFold(method, sent) || strings.EqualFold(method, r.Method) || strings.EqualFold(method, effective) {
+      return http.StatusNotImplemented
+    }
+  }
+  return 0
+}
+
+// rejection responds to requests refused before routing with its status
+// code, see Drain and DisallowedMethods.
+type rejection int
+
+func (status rejection) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if status == http.StatusServiceUnavailable {
+    w.Header().Set("Retry-After", drainRetryAfter)
+  }
+  http.Error(w, http.StatusText(int(status)), int(status))
+}
+
+// Undrain makes the handler serve requests again after Drain.
+func (h *RegexpHandler) Undrain() {
+  h.draining.Store(false)
+}
+
+// Match returns the route that would serve a request and its submatches,
+// without calling the route's function. It reports false if no route matches
+// the request, including when only the request's method doesn't match. Match
+// doesn't read the request's body, so with MethodOverride, only the
+// X-HTTP-Method-Override header is honored, not the _method form field.
+func (h *RegexpHandler) Match(r *http.Request) (*Route, []string, bool) {
+  r, redirect := h.cleanPath(h.overrideMethod(r, false))
+  if redirect != "" || h.canonicalHostRedirect(r) != "" {
+    return nil, nil, false
+  }
+  h.mu.RLock()
+  m := h.match(h.routes, h.combined, r)
+  h.mu.RUnlock()
+  return m.route, m.submatches, m.route != nil
+}
+
+// canonicalHostRedirect returns the URL a request should be redirected to on
+// CanonicalHost, or "" if it is already for CanonicalHost.
+func (h *RegexpHandler) canonicalHostRedirect(r *http.Request) string {
+  if h.CanonicalHost == "" || r.Host == "" {
+    return ""
+  }
+  host := r.Host
+  if !strings.Contains(h.CanonicalHost, ":") {
+    host = stripPort(host)
+  }
+  if strings.EqualFold(host, h.CanonicalHost) {
+    return ""
+  }
+  return h.scheme(r) + "://" + h.CanonicalHost + r.URL.RequestURI()
+}
+
+// overrideMethod returns the request with its method replaced as configured
+// by MethodOverride. The form is only read if readForm is set, so that the
+// body is left alone otherwise.
+func (h *RegexpHandler) overrideMethod(r *http.Request, readForm bool) *http.Request {
+  if !h.MethodOverride || r.Method != http.MethodPost {
+    return r
+  }
+  method := r.Header.Get("X-HTTP-Method-Override")
+  if method == "" {
+    if !readForm {
+      return r
+    }
+    if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/x-www-form-urlencoded" {
+      return r
+    }
+    r2 := *r
+    if h.MaxBodyBytes > 0 && r.Body != nil {
+      r2.Body = http.MaxBytesReader(nil, r.Body, h.MaxBodyBytes)
+    }
+    r = &r2
+    method = r.PostFormValue("_method")
+  }
+  switch method = strings.ToUpper(method); method {
+  case http.MethodPut, http.MethodPatch, http.MethodDelete:
+    r2 := *r
+    r2.Method = method
+    return &r2
+  }
+  return r
+}
+
+// cleanPath returns the request with its path cleaned if CleanPath is set, or
+// the URL to redirect it to if RedirectCleanPath is also set.
+func (h *RegexpHandler) cleanPath(r *http.Request) (*http.Request, string) {
+  if !h.CleanPath || r.URL.Path == "" {
+    return r, ""
+  }
+  cleaned := path.Clean("/" + r.URL.Path)
+  if strings.HasSuffix(r.URL.Path, "/") && cleaned != "/" {
+    cleaned += "/"
+  }
+  if cleaned == r.URL.Path {
+    return r, ""
+  }
+  u := *r.URL
+  u.Path = cleaned
+  u.RawPath = ""
+  if h.RedirectCleanPath && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+    location := u.EscapedPath()
+    if u.RawQuery != "" {
+      location += "?" + u.RawQuery
+    }
+    return r, location
+  }
+  r2 := *r
+  r2.URL = &u
+  return &r2, ""
+}
+
+// matches reports whether a request matches one of the handler's routes.
+func (h *RegexpHandler) matches(r *http.Request) bool {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  return h.find(h.routes, h.combined, r, h.method(r)).route != nil
+}
+
+// match selects the route that should serve a request. It must be called with
+// the handler's lock held.
+func (h *RegexpHandler) match(routes []*Route, c *combined, r *http.Request) *match {
+  if h.MaxURILen > 0 && len(requestURI(r)) > h.MaxURILen {
+    return &match{status: http.StatusRequestURITooLong}
+  }
+  if h.MaxPathLen > 0 && len(h.path(r)) > h.MaxPathLen {
+    return &match{status: http.StatusRequestURITooLong}
+  }
+  method := h.method(r)
+  m := h.find(routes, c, r, method)
+  if m.route == nil && h.AutoHEAD && method == http.MethodHead {
+    if get := h.find(routes, c, r, http.MethodGet); get.route != nil {
+      get.head = true
+      m = get
+    }
+  }
+  if m.route == nil && h.RedirectTrailingSlash && len(m.allowed) == 0 {
+    m.redirect = h.trailingSlashRedirect(routes, r)
+  }
+  if m.route == nil {
+    m.finals = h.finals
+  }
+  if m.route != nil {
+    if m.route.weight > 0 {
+      h.chooseWeighted(routes, r, m, method)
+    }
+    h.selected(routes, m)
+  }
+  return m
+}
+
+// selected completes a match for the route that was selected.
+func (h *RegexpHandler) selected(routes []*Route, m *match) {
+  m.name, m.middleware, m.recover = m.route.name, m.route.middleware, m.route.recover
+  for i, rt := range routes {
+    if rt == m.route {
+      m.index = i
       break
     }
   }
+  if m.route.group != nil || len(h.matched) > 0 {
+    middleware := append([]func(http.Handler) http.Handler(nil), h.matched...)
+    if m.route.group != nil {
+      middleware = append(middleware, m.route.group.chain()...)
+    }
+    m.middleware = append(middleware, m.route.middleware...)
+  }
+  if h.DecodeSubmatches {
+    for i, s := range m.submatches {
+      unescaped, err := url.PathUnescape(s)
+      if err != nil {
+        m.status = http.StatusBadRequest
+        break
+      }
+      m.submatches[i] = unescaped
+    }
+  }
+}
+
+// passThrough replaces a match whose route passed the request through, see
+// ErrPassThrough, with a match for the next route that matches it.
+func (h *RegexpHandler) passThrough(r *http.Request, m *match) {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  method := h.method(r)
+  if m.head {
+    method = http.MethodGet
+  }
+  next := &match{path: m.path, head: m.head, rw: m.rw, writer: m.writer, start: m.start, finals: h.finals}
+  if h.Matcher == nil {
+    for i, rt := range h.routes {
+      if rt == m.route {
+        h.scan(next, h.routes[i+1:], r, m.path, method)
+        break
+      }
+    }
+  }
+  if next.route != nil {
+    next.finals = nil
+    h.selected(h.routes, next)
+    if h.TrackCoverage {
+      atomic.AddInt64(&next.route.hits, 1)
+    }
+  }
+  *m = *next
+}
+
+// find returns the first route that matches a request with the given method.
+// If c is non-nil, it is used to skip the routes whose expressions don't
+// match; otherwise the prefix index, if any, is.
+func (h *RegexpHandler) find(routes []*Route, c *combined, r *http.Request, method string) *match {
+  path := h.path(r)
+  m := &match{path: path}
+  if h.Matcher != nil {
+    if i, submatches, ok := h.Matcher.Match(path, method); ok && i >= 0 && i < len(routes) {
+      m.route, m.submatches = routes[i], submatches
+    }
+    return m
+  }
+  if len(routes) == 1 {
+    // A single route is matched directly, skipping the indexes below. The
+    // combined expression in particular costs an allocation and more time
+    // than matching the route itself.
+    h.scan(m, routes, r, path, method)
+    return m
+  }
+  if h.exact != nil && h.MatchMode == MatchFirst {
+    if rt := h.findLiteral(routes, r, path, method); rt != nil {
+      m.route, m.submatches = rt, []string{}
+      return m
+    }
+  }
+  if c != nil && h.MatchMode == MatchFirst {
+    i, submatches, ok := c.match(path)
+    if !ok {
+      return m
+    }
+    if rt := routes[i]; rt.matchesRequest(r) && rt.matchesMethod(method) {
+      if rt.longest {
+        submatches = rt.re.FindStringSubmatch(path)[1:]
+      }
+      m.route, m.submatches = rt, submatches
+      if rt.accept != "" {
+        m.route, m.submatches = h.negotiate(rt, submatches, routes[i+1:], r, path, method)
+      }
+      return m
+    }
+    routes = routes[i:]
+  } else if h.prefixes != nil {
+    h.prefixes.scan(h, m, routes, r, path, method)
+    return m
+  }
+  h.scan(m, routes, r, path, method)
+  return m
+}
+
+// scan tries the routes one by one, storing the route that matches a request
+// with the given path and method in m.
+func (h *RegexpHandler) scan(m *match, routes []*Route, r *http.Request, path, method string) {
+  for i := range routes {
+    if h.try(m, routes, i, r, path, method) {
+      return
+    }
+  }
+}
+
+// try tries the i'th of routes for scan, and reports whether the search is
+// over.
+func (h *RegexpHandler) try(m *match, routes []*Route, i int, r *http.Request, path, method string) bool {
+  rt := routes[i]
+  if !strings.HasPrefix(path, rt.literalPrefix) {
+    return false
+  }
+  submatches, ok := rt.submatches(path)
+  if !ok || !rt.matchesRequest(r) {
+    return false
+  }
+  if !rt.matchesMethod(method) {
+    for _, rm := range rt.methods {
+      m.allowed = appendMethod(m.allowed, rm)
+    }
+    return false
+  }
+  if h.MatchMode != MatchSpecific {
+    m.route, m.submatches = rt, submatches
+    if rt.accept != "" {
+      m.route, m.submatches = h.negotiate(rt, submatches, routes[i+1:], r, path, method)
+    }
+    return true
+  }
+  if m.route == nil || rt.literals > m.route.literals {
+    m.route, m.submatches = rt, submatches
+  }
+  return false
+}
+
+// trailingSlashRedirect returns the URL a request should be redirected to
+// with a trailing slash added to or removed from its path, or "" if neither
+// variant matches a route.
+func (h *RegexpHandler) trailingSlashRedirect(routes []*Route, r *http.Request) string {
+  u := *r.URL
+  if strings.HasSuffix(u.Path, "/") {
+    if u.Path == "/" {
+      return ""
+    }
+    u.Path = strings.TrimSuffix(u.Path, "/")
+  } else {
+    u.Path += "/"
+  }
+  u.RawPath = ""
+  r2 := *r
+  r2.URL = &u
+  if h.find(routes, nil, &r2, h.method(r)).route == nil {
+    return ""
+  }
+  location := localPath(u.EscapedPath())
+  if u.RawQuery != "" {
+    location += "?" + u.RawQuery
+  }
+  return location
+}
+
+// requestURI returns the request's URI as sent by the client, or as it would
+// be sent for requests made by clients.
+func requestURI(r *http.Request) string {
+  if r.RequestURI != "" {
+    return r.RequestURI
+  }
+  return r.URL.RequestURI()
+}
+
+// method returns the method a request's route is selected by.
+func (h *RegexpHandler) method(r *http.Request) string {
+  if h.MethodFunc != nil {
+    return h.MethodFunc(r)
+  }
+  return r.Method
+}
+
+// path returns the string a request's route is selected by.
+func (h *RegexpHandler) path(r *http.Request) string {
+  if h.PathFunc != nil {
+    return h.PathFunc(r)
+  }
+  if h.MatchRawQuery {
+    return r.URL.RequestURI()
+  }
+  return r.URL.Path
+}
+
+// dispatcher is the innermost handler of the middleware chain. Unlike the
+// method value h.dispatch, it can be converted to an http.Handler without
+// allocating.
+type dispatcher struct {
+  h *RegexpHandler
+}
+
+func (d dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  d.h.dispatch(w, r)
+}
+
+// dispatch serves a request using the match stored in its context.
+func (h *RegexpHandler) dispatch(w http.ResponseWriter, r *http.Request) {
+  m := matchFromContext(r)
+  if m.status != 0 {
+    http.Error(w, http.StatusText(m.status), m.status)
+    return
+  }
+  if m.route != nil {
+    if m.head {
+      w = &headWriter{w}
+    }
+    if h.MaxBodyBytes > 0 && r.Body != nil {
+      r2 := *r
+      r2.Body = http.MaxBytesReader(w, r.Body, h.MaxBodyBytes)
+      r = &r2
+    }
+    for m.route != nil {
+      if h.SkipCancelled && r.Context().Err() != nil {
+        m.writer.status = statusClientClosed
+        return
+      }
+      if h.call(w, r, m); !m.passed {
+        return
+      }
+      if h.passThrough(r, m); m.status != 0 {
+        http.Error(w, http.StatusText(m.status), m.status)
+        return
+      }
+    }
+  }
+  if h.HandleOPTIONS && h.method(r) == http.MethodOptions && len(m.allowed) > 0 {
+    w.Header().Set("Allow", strings.Join(appendMethod(m.allowed, http.MethodOptions), ", "))
+    w.WriteHeader(http.StatusNoContent)
+    return
+  }
+  if h.MethodNotAllowed && len(m.allowed) > 0 {
+    w.Header().Set("Allow", strings.Join(m.allowed, ", "))
+    http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+    return
+  }
+  if m.redirect != "" {
+    code := http.StatusPermanentRedirect
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+      code = http.StatusMovedPermanently
+    }
+    http.Redirect(w, r, m.redirect, code)
+    return
+  }
+  if len(m.finals) > 0 {
+    rw := &responseWriter{ResponseWriter: w}
+    for _, final := range m.finals {
+      if final(rw, r, []string{}); rw.written() {
+        return
+      }
+    }
+  }
+  if h.NotFound != nil {
+    h.NotFound.ServeHTTP(w, r)
+  } else if h.WriteNotFound {
+    http.NotFound(w, r)
+  }
+}
+
+// call calls the function of the matched route, recovering from panics if
+// configured to.
+func (h *RegexpHandler) call(w http.ResponseWriter, r *http.Request, m *match) {
+  recoverHandler := h.RecoverHandler
+  if m.recover != nil {
+    recoverHandler = m.recover
+  }
+  if h.Recover || recoverHandler != nil {
+    defer func() {
+      v := recover()
+      if v == nil {
+        return
+      }
+      if v == http.ErrAbortHandler {
+        panic(v)
+      }
+      if recoverHandler != nil {
+        recoverHandler(w, r, v)
+      } else {
+        http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+      }
+    }()
+  }
+  m.route.serve(w, r, m.submatches, m.middleware)
+}
+
+// appendMethod appends method to methods in upper case, unless it is already
+// present.
+func appendMethod(methods []string, method string) []string {
+  method = strings.ToUpper(method)
+  for _, m := range methods {
+    if m == method {
+      return methods
+    }
+  }
+  return append(methods, method)
 }
@@ -0,0 +1,2569 @@
+package handler
+
+import (
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// serve sends a request with the given method and path to h and returns the
+// recorded response.
+func serve(h http.Handler, method, path string) *httptest.ResponseRecorder {
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+  return rec
+}
+
+// write returns a route function that writes body.
+func write(body string) func(http.ResponseWriter, *http.Request, []string) {
+  return func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(body))
+  }
+}
+
+func TestAddEInvalidExpression(t *testing.T) {
+  h := NewRegexpHandler()
+  for _, expression := range []string{"(", "[a-", "a**", "(?P<>x)"} {
+    if err := h.AddE(expression, write("x")); err == nil {
+      t.Errorf("AddE(%q) returned nil error", expression)
+    }
+  }
+  if len(h.Routes()) != 0 {
+    t.Errorf("invalid expressions registered routes: %v", h.Routes())
+  }
+}
+
+func TestAddEAnchorsExpression(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddE("/a", write("a")); err != nil {
+    t.Fatal(err)
+  }
+  if body := serve(h, "GET", "/a").Body.String(); body != "a" {
+    t.Errorf("/a: got %q, want %q", body, "a")
+  }
+  for _, path := range []string{"/ab", "/x/a"} {
+    if body := serve(h, "GET", path).Body.String(); body != "" {
+      t.Errorf("%s: got %q, want no match", path, body)
+    }
+  }
+}
+
+func TestAddPanicsOnInvalidExpression(t *testing.T) {
+  defer func() {
+    if recover() == nil {
+      t.Error("Add(\"(\") did not panic")
+    }
+  }()
+  NewRegexpHandler().Add("(", write("x"))
+}
+
+func TestAddMethod(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("GET", "/items", write("get"))
+  h.AddMethod("post", "/items", write("post"))
+  h.Add("/items", write("any"))
+  for _, tt := range []struct{ method, want string }{
+    {"GET", "get"},
+    {"get", "get"},
+    {"POST", "post"},
+    {"DELETE", "any"},
+  } {
+    if body := serve(h, tt.method, "/items").Body.String(); body != tt.want {
+      t.Errorf("%s /items: got %q, want %q", tt.method, body, tt.want)
+    }
+  }
+}
+
+func TestAddMethodPrecedence(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("first"))
+  h.AddMethod("GET", "/a", write("second"))
+  if body := serve(h, "GET", "/a").Body.String(); body != "first" {
+    t.Errorf("got %q, want the first matching route", body)
+  }
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MethodNotAllowed = true
+  h.AddMethod("GET", "/items/(\\d+)", write("get"))
+  h.AddMethod("POST", "/items/\\d+", write("post"))
+  rec := serve(h, "DELETE", "/items/1")
+  if rec.Code != http.StatusMethodNotAllowed {
+    t.Errorf("got status %d, want 405", rec.Code)
+  }
+  if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+    t.Errorf("got Allow %q, want %q", allow, "GET, POST")
+  }
+  if rec := serve(h, "DELETE", "/other"); rec.Code == http.StatusMethodNotAllowed {
+    t.Error("unmatched path answered with 405")
+  }
+}
+
+func TestMethodNotAllowedOptIn(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("GET", "/items", write("get"))
+  rec := serve(h, "DELETE", "/items")
+  if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Allow") != "" {
+    t.Errorf("got %d %q without MethodNotAllowed, want an empty 200", rec.Code, rec.Body.String())
+  }
+}
+
+func TestAddNamed(t *testing.T) {
+  h := NewRegexpHandler()
+  var got map[string]string
+  h.AddNamed("/users/(?P<id>\\d+)/(\\w+)/(?P<post>\\d+)", func(w http.ResponseWriter, r *http.Request, named map[string]string) {
+    got = named
+  })
+  serve(h, "GET", "/users/42/posts/7")
+  if len(got) != 2 || got["id"] != "42" || got["post"] != "7" {
+    t.Errorf("got %v, want map[id:42 post:7]", got)
+  }
+}
+
+func TestAddNamedDuplicateNameLastWins(t *testing.T) {
+  h := NewRegexpHandler()
+  var got map[string]string
+  h.AddNamed("/(?P<x>a)/(?P<x>b)", func(w http.ResponseWriter, r *http.Request, named map[string]string) {
+    got = named
+  })
+  serve(h, "GET", "/a/b")
+  if got["x"] != "b" {
+    t.Errorf("got x=%q, want the last group's %q", got["x"], "b")
+  }
+}
+
+func TestNotFound(t *testing.T) {
+  h := NewRegexpHandler()
+  var got *http.Request
+  h.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    got = r
+    http.Error(w, "custom", http.StatusNotFound)
+  })
+  h.Add("/a", write("a"))
+  rec := serve(h, "GET", "/missing?q=1")
+  if rec.Code != http.StatusNotFound || rec.Body.String() != "custom\n" {
+    t.Errorf("got %d %q, want the NotFound response", rec.Code, rec.Body.String())
+  }
+  if got == nil || got.URL.Path != "/missing" || got.URL.RawQuery != "q=1" {
+    t.Errorf("NotFound received %v, want the original request", got)
+  }
+  if body := serve(h, "GET", "/a").Body.String(); body != "a" {
+    t.Errorf("got %q, want the matching route to take precedence", body)
+  }
+}
+
+func TestNotFoundNil(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+    t.Errorf("got %d %q, want nothing written", rec.Code, rec.Body.String())
+  }
+}
+
+func TestConcurrentAdd(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/base", write("base"))
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(2)
+    go func(i int) {
+      defer wg.Done()
+      for j := 0; j < 50; j++ {
+        h.Add(fmt.Sprintf("/r%d/%d", i, j), write("r"))
+      }
+    }(i)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 50; j++ {
+        if body := serve(h, "GET", "/base").Body.String(); body != "base" {
+          t.Errorf("got %q while adding routes", body)
+          return
+        }
+        serve(h, "GET", "/r0/1")
+      }
+    }()
+  }
+  wg.Wait()
+  if n := len(h.Routes()); n != 201 {
+    t.Errorf("got %d routes, want 201", n)
+  }
+  if body := serve(h, "GET", "/r3/49").Body.String(); body != "r" {
+    t.Errorf("got %q for a route added concurrently", body)
+  }
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+  h := NewRegexpHandler()
+  for i := 0; i < 10; i++ {
+    h.Add(fmt.Sprintf("/r%d/(\\d+)", i), write("r"))
+  }
+  r := httptest.NewRequest("GET", "/r9/42", nil)
+  w := httptest.NewRecorder()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    h.ServeHTTP(w, r)
+  }
+}
+
+func BenchmarkServeHTTPParallel(b *testing.B) {
+  h := NewRegexpHandler()
+  for i := 0; i < 10; i++ {
+    h.Add(fmt.Sprintf("/r%d/(\\d+)", i), write("r"))
+  }
+  b.ReportAllocs()
+  b.RunParallel(func(pb *testing.PB) {
+    r := httptest.NewRequest("GET", "/r9/42", nil)
+    w := httptest.NewRecorder()
+    for pb.Next() {
+      h.ServeHTTP(w, r)
+    }
+  })
+}
+
+// never returns false, for routes that must not match anything.
+func never() bool { return false }
+
+// singleRouteHandlers returns pairs of handlers that serve requests the same
+// way, the first with a single route and the second with a route after it
+// that never matches, so that it takes the general path.
+func singleRouteHandlers() [][2]*RegexpHandler {
+  var pairs [][2]*RegexpHandler
+  for _, add := range []func(h *RegexpHandler){
+    func(h *RegexpHandler) { h.Add(".*", write("all")) },
+    func(h *RegexpHandler) {
+      h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+        fmt.Fprint(w, m, SubmatchesFromContext(r))
+      })
+    },
+    func(h *RegexpHandler) { h.AddMethod("POST", "/users/(\\d+)", write("post")) },
+    func(h *RegexpHandler) { h.AddHost("api\\.example\\.com", "/(.*)", write("api")) },
+    func(h *RegexpHandler) { h.AddLiteral("/health", write("ok")) },
+    func(h *RegexpHandler) { h.AddAccept("application/json", "/data", write("json")) },
+    func(h *RegexpHandler) { h.Add("/(a|ab)(c?)", write("alt")).Longest() },
+  } {
+    var pair [2]*RegexpHandler
+    for i := range pair {
+      h := NewRegexpHandler()
+      h.MethodNotAllowed = true
+      h.AutoHEAD = true
+      h.HandleOPTIONS = true
+      add(h)
+      if i == 1 {
+        h.AddIf(never, ".*", write("never"))
+      }
+      pair[i] = h
+    }
+    pairs = append(pairs, pair)
+  }
+  return pairs
+}
+
+func TestSingleRoute(t *testing.T) {
+  for _, compile := range []bool{false, true} {
+    for _, pair := range singleRouteHandlers() {
+      for _, h := range pair {
+        if compile {
+          if err := h.Compile(); err != nil {
+            t.Fatal(err)
+          }
+        }
+      }
+      for _, method := range []string{"GET", "HEAD", "POST", "OPTIONS"} {
+        for _, host := range []string{"example.com", "api.example.com"} {
+          for _, path := range []string{"/", "/users/42", "/users/x", "/health", "/data", "/abc", "/ac"} {
+            var got [2]string
+            for i, h := range pair {
+              rec := httptest.NewRecorder()
+              r := request(method, path, host)
+              r.Header.Set("Accept", "application/json")
+              h.ServeHTTP(rec, r)
+              _, submatches, ok := h.Match(r)
+              got[i] = fmt.Sprintf("%d %q %q %q %v", rec.Code, rec.Header().Get("Allow"), rec.Body.String(), submatches, ok)
+            }
+            if got[0] != got[1] {
+              t.Errorf("compiled %v, %s %s%s: got %s with one route, %s with the general path", compile, method, host, path, got[0], got[1])
+            }
+          }
+        }
+      }
+    }
+  }
+}
+
+// benchmarkSingleRoute measures serving a request with a single compiled
+// route, or, with general set, with another that never matches after it.
+func benchmarkSingleRoute(b *testing.B, general bool) {
+  h := NewRegexpHandler()
+  h.Add("/users/(\\d+)", write("user"))
+  if general {
+    h.AddIf(never, ".*", write("never"))
+  }
+  if err := h.Compile(); err != nil {
+    b.Fatal(err)
+  }
+  r := httptest.NewRequest("GET", "/users/42", nil)
+  w := httptest.NewRecorder()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    h.ServeHTTP(w, r)
+  }
+}
+
+func BenchmarkSingleRoute(b *testing.B)        { benchmarkSingleRoute(b, false) }
+func BenchmarkSingleRouteGeneral(b *testing.B) { benchmarkSingleRoute(b, true) }
+
+func TestAddRegexpVerbatim(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddRegexp(regexp.MustCompile("(?i)^/files/(.+)"), func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(m[0]))
+  })
+  if body := serve(h, "GET", "/FILES/a/b").Body.String(); body != "a/b" {
+    t.Errorf("got %q, want %q", body, "a/b")
+  }
+  if body := serve(h, "GET", "/x/files/a").Body.String(); body != "" {
+    t.Errorf("got %q, want no match", body)
+  }
+}
+
+func TestAddRegexpSharedAcrossHandlers(t *testing.T) {
+  re := regexp.MustCompile("^/shared$")
+  h1, h2 := NewRegexpHandler(), NewRegexpHandler()
+  h1.AddRegexp(re, write("1"))
+  h2.AddRegexp(re, write("2"))
+  if serve(h1, "GET", "/shared").Body.String() != "1" || serve(h2, "GET", "/shared").Body.String() != "2" {
+    t.Error("a shared regexp did not match in both handlers")
+  }
+}
+
+func TestCaseInsensitive(t *testing.T) {
+  h := NewRegexpHandler()
+  h.CaseInsensitive = true
+  h.Add("/Users/(\\d+)", write("user"))
+  for _, path := range []string{"/Users/42", "/users/42", "/USERS/42"} {
+    if body := serve(h, "GET", path).Body.String(); body != "user" {
+      t.Errorf("%s: got %q, want a match", path, body)
+    }
+  }
+}
+
+func TestCaseInsensitiveReadAtAdd(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/before", write("before"))
+  h.CaseInsensitive = true
+  h.Add("/after", write("after"))
+  h.CaseInsensitive = false
+  if body := serve(h, "GET", "/BEFORE").Body.String(); body != "" {
+    t.Errorf("route added before CaseInsensitive was set matched %q", body)
+  }
+  if body := serve(h, "GET", "/AFTER").Body.String(); body != "after" {
+    t.Errorf("route added with CaseInsensitive set got %q", body)
+  }
+}
+
+func TestRemove(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/(a)", write("first"))
+  h.Add("/b", write("middle"))
+  h.Add("/(a|b)", write("last"))
+  if !h.Remove("/b") {
+    t.Fatal("Remove(\"/b\") = false")
+  }
+  if h.Remove("/b") {
+    t.Error("second Remove(\"/b\") = true")
+  }
+  if body := serve(h, "GET", "/a").Body.String(); body != "first" {
+    t.Errorf("/a: got %q, want %q", body, "first")
+  }
+  if body := serve(h, "GET", "/b").Body.String(); body != "last" {
+    t.Errorf("/b: got %q, want %q", body, "last")
+  }
+  routes := h.Routes()
+  if len(routes) != 2 || routes[0].Expression != "/(a)" || routes[1].Expression != "/(a|b)" {
+    t.Errorf("got routes %v, want the first and last in order", routes)
+  }
+}
+
+func TestRoutes(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  h.AddMethod("get", "/b/(\\d+)", write("b"))
+  h.AddMethods([]string{"PUT", "PATCH"}, "/c", write("c"))
+  want := []RouteInfo{
+    {Expression: "/a"},
+    {Expression: "/b/(\\d+)", Method: "GET"},
+    {Expression: "/c", Method: "PUT, PATCH"},
+  }
+  routes := h.Routes()
+  if len(routes) != len(want) {
+    t.Fatalf("got %v, want %v", routes, want)
+  }
+  for i := range want {
+    if routes[i] != want[i] {
+      t.Errorf("route %d: got %v, want %v", i, routes[i], want[i])
+    }
+  }
+  routes[0].Expression = "/changed"
+  if h.Routes()[0].Expression != "/a" {
+    t.Error("modifying the result of Routes changed the handler")
+  }
+}
+
+// record returns a middleware that appends name and the request's submatches
+// to log before calling the next handler.
+func record(log *[]string, name string) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      *log = append(*log, fmt.Sprint(name, SubmatchesFromContext(r)))
+      next.ServeHTTP(w, r)
+    })
+  }
+}
+
+func TestUse(t *testing.T) {
+  h := NewRegexpHandler()
+  var log []string
+  h.Use(record(&log, "outer"))
+  h.Use(record(&log, "inner"))
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, fmt.Sprint("route", m))
+  })
+  serve(h, "GET", "/users/42")
+  if got := fmt.Sprint(log); got != "[outer[42] inner[42] route[42]]" {
+    t.Errorf("got %s", got)
+  }
+}
+
+func TestUseStopsDispatch(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      http.Error(w, "denied", http.StatusUnauthorized)
+    })
+  })
+  called := false
+  h.Add("/a", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  if rec := serve(h, "GET", "/a"); rec.Code != http.StatusUnauthorized || called {
+    t.Errorf("got %d, called %v; want 401 without calling the route", rec.Code, called)
+  }
+}
+
+func TestMatchRawQuery(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MatchRawQuery = true
+  h.Add("/search\\?type=(image|video)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(m[0]))
+  })
+  for path, want := range map[string]string{
+    "/search?type=image": "image",
+    "/search?type=video": "video",
+    "/search?type=text":  "",
+    "/search":            "",
+  } {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RedirectTrailingSlash = true
+  h.Add("/users/(\\d+)", write("user"))
+  h.Add("/docs/", write("docs"))
+  for _, tt := range []struct {
+    method, path string
+    code         int
+    location     string
+  }{
+    {"GET", "/users/42/", http.StatusMovedPermanently, "/users/42"},
+    {"HEAD", "/docs?page=2", http.StatusMovedPermanently, "/docs/?page=2"},
+    {"POST", "/users/42/?a=b", http.StatusPermanentRedirect, "/users/42?a=b"},
+  } {
+    rec := serve(h, tt.method, tt.path)
+    if rec.Code != tt.code || rec.Header().Get("Location") != tt.location {
+      t.Errorf("%s %s: got %d %q, want %d %q", tt.method, tt.path, rec.Code, rec.Header().Get("Location"), tt.code, tt.location)
+    }
+  }
+  if rec := serve(h, "GET", "/other/"); rec.Code != http.StatusOK || rec.Header().Get("Location") != "" {
+    t.Errorf("got %d %q for a path no variant of which matches", rec.Code, rec.Header().Get("Location"))
+  }
+}
+
+func TestRedirectTrailingSlashStaysLocal(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RedirectTrailingSlash = true
+  h.Add("/(.*[^/])", write("any"))
+  if location := serve(h, "GET", "//evil.com/").Header().Get("Location"); location != "/evil.com" {
+    t.Errorf("got Location %q, want /evil.com", location)
+  }
+}
+
+// request returns a request with the given method and path for host.
+func request(method, path, host string) *http.Request {
+  r := httptest.NewRequest(method, path, nil)
+  r.Host = host
+  return r
+}
+
+func TestAddHost(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddHost("api\\.example\\.com", "/", write("api"))
+  h.AddHost("www\\.example\\.com", "/", write("www"))
+  h.Add("/", write("any"))
+  for host, want := range map[string]string{
+    "api.example.com":      "api",
+    "api.example.com:8080": "api",
+    "www.example.com":      "www",
+    "other.com":            "any",
+  } {
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, request("GET", "/", host))
+    if rec.Body.String() != want {
+      t.Errorf("%s: got %q, want %q", host, rec.Body.String(), want)
+    }
+  }
+}
+
+func TestAddTimeout(t *testing.T) {
+  h := NewRegexpHandler()
+  done := make(chan struct{})
+  h.AddTimeout("/slow/(\\d+)", 10*time.Millisecond, func(w http.ResponseWriter, r *http.Request, m []string) {
+    defer close(done)
+    select {
+    case <-r.Context().Done():
+    case <-time.After(time.Second):
+    }
+    w.Write([]byte("late " + m[0]))
+  })
+  h.AddTimeout("/fast/(\\d+)", time.Second, func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte("fast " + m[0]))
+  })
+  rec := serve(h, "GET", "/slow/1")
+  if rec.Code != http.StatusServiceUnavailable || strings.Contains(rec.Body.String(), "late") {
+    t.Errorf("got %d %q, want 503 without the late body", rec.Code, rec.Body.String())
+  }
+  <-done
+  if rec := serve(h, "GET", "/fast/2"); rec.Code != http.StatusOK || rec.Body.String() != "fast 2" {
+    t.Errorf("got %d %q, want the function's response", rec.Code, rec.Body.String())
+  }
+}
+
+func TestMount(t *testing.T) {
+  sub := NewRegexpHandler()
+  sub.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(r.URL.Path + " " + m[0]))
+  })
+  h := NewRegexpHandler()
+  h.Mount("/api/v1", sub)
+  h.Add("/api/v1/(.*)", write("fallthrough"))
+  for path, want := range map[string]string{
+    "/api/v1/users/42": "/users/42 42",
+    "/api/v1/other":    "fallthrough",
+    "/api/v2/users/42": "",
+    "/users/42":        "",
+  } {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+}
+
+func TestMountNotFound(t *testing.T) {
+  sub := NewRegexpHandler()
+  sub.Add("/users/(\\d+)", write("user"))
+  sub.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusNotFound)
+    w.Write([]byte(`{"error":"not found"}`))
+  })
+  h := NewRegexpHandler()
+  h.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "<h1>not found</h1>", http.StatusNotFound)
+  })
+  h.Mount("/api", sub)
+  h.Add("/api/(.*)", write("fallthrough"))
+  h.Add("/about", write("about"))
+  for _, test := range []struct{ path, want string }{
+    {"/api/users/42", "user"},
+    {"/api/missing", `{"error":"not found"}`},
+    {"/missing", "<h1>not found</h1>\n"},
+    {"/about", "about"},
+  } {
+    if body := serve(h, "GET", test.path).Body.String(); body != test.want {
+      t.Errorf("%s: got %q, want %q", test.path, body, test.want)
+    }
+  }
+}
+
+func TestMountPrefixIsLiteral(t *testing.T) {
+  sub := NewRegexpHandler()
+  sub.Add("/x", write("x"))
+  h := NewRegexpHandler()
+  h.Mount("/a.b", sub)
+  if body := serve(h, "GET", "/aXb/x").Body.String(); body != "" {
+    t.Errorf("got %q, want the prefix to be matched literally", body)
+  }
+  if body := serve(h, "GET", "/a.b/x").Body.String(); body != "x" {
+    t.Errorf("got %q, want %q", body, "x")
+  }
+}
+
+func TestAnchorMode(t *testing.T) {
+  for _, tt := range []struct {
+    mode       AnchorMode
+    expression string
+    match      []string
+    noMatch    []string
+  }{
+    {AnchorBoth, "/static/", []string{"/static/"}, []string{"/static/css/app.css", "/x/static/"}},
+    {AnchorStart, "/static/", []string{"/static/", "/static/css/app.css"}, []string{"/x/static/"}},
+    {AnchorNone, "/static/", []string{"/static/", "/static/css/app.css", "/x/static/a"}, []string{"/static"}},
+    {AnchorEnd, "\\.json", []string{"/data.json", "/a/b.json"}, []string{"/data.json/x"}},
+  } {
+    h := NewRegexpHandler()
+    h.AnchorMode = tt.mode
+    h.Add(tt.expression, write("match"))
+    for _, path := range tt.match {
+      if body := serve(h, "GET", path).Body.String(); body != "match" {
+        t.Errorf("mode %d: %q does not match %s", tt.mode, tt.expression, path)
+      }
+    }
+    for _, path := range tt.noMatch {
+      if body := serve(h, "GET", path).Body.String(); body != "" {
+        t.Errorf("mode %d: %q matches %s", tt.mode, tt.expression, path)
+      }
+    }
+  }
+}
+
+func TestAnchorModeMixed(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AnchorMode = AnchorStart
+  h.Add("/static/", write("static"))
+  h.AnchorMode = AnchorBoth
+  h.Add("/(.*)", write("exact"))
+  if body := serve(h, "GET", "/static/app.css").Body.String(); body != "static" {
+    t.Errorf("got %q, want the AnchorStart route", body)
+  }
+}
+
+func TestTolerateLeadingSlash(t *testing.T) {
+  h := NewRegexpHandler()
+  h.TolerateLeadingSlash = true
+  h.Add("users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    fmt.Fprintf(w, "users %q", m)
+  })
+  h.Add("/posts/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    fmt.Fprintf(w, "posts %q", m)
+  })
+  h.Add("(.*)/raw", func(w http.ResponseWriter, r *http.Request, m []string) {
+    fmt.Fprintf(w, "raw %q", m)
+  })
+  h.TolerateLeadingSlash = false
+  h.Add("files/(.*)", write("files"))
+  for _, test := range []struct{ path, want string }{
+    {"/users/42", `users ["42"]`},
+    {"users/42", `users ["42"]`},
+    {"/posts/7", `posts ["7"]`},
+    {"posts/7", `posts ["7"]`},
+    {"//posts/7", ""},
+    {"/a/raw", `raw ["a"]`},
+    {"a/raw", `raw ["a"]`},
+    {"/files/x", ""},
+    {"files/x", "files"},
+  } {
+    r := httptest.NewRequest("GET", "/", nil)
+    r.URL.Path = test.path
+    rec := httptest.NewRecorder()
+    if h.ServeHTTP(rec, r); rec.Body.String() != test.want {
+      t.Errorf("%s: got %q, want %q", test.path, rec.Body.String(), test.want)
+    }
+  }
+}
+
+func TestAnchorModeHostFullyAnchored(t *testing.T) {
+  for _, mode := range []AnchorMode{AnchorBoth, AnchorStart, AnchorNone, AnchorEnd} {
+    h := NewRegexpHandler()
+    h.AnchorMode = mode
+    h.TolerateLeadingSlash = true
+    h.AddHost("example\\.com", "/", write("host"))
+    for host, want := range map[string]string{
+      "example.com":          "host",
+      "example.com.evil.net": "",
+      "notexample.com":       "",
+    } {
+      rec := httptest.NewRecorder()
+      h.ServeHTTP(rec, request("GET", "/", host))
+      if rec.Body.String() != want {
+        t.Errorf("mode %d, host %s: got %q, want %q", mode, host, rec.Body.String(), want)
+      }
+    }
+  }
+}
+
+func TestHandleOPTIONS(t *testing.T) {
+  h := NewRegexpHandler()
+  h.HandleOPTIONS = true
+  h.AddMethod("GET", "/items", write("get"))
+  h.AddMethod("POST", "/items", write("post"))
+  h.AddMethod("GET", "/custom", write("get"))
+  h.AddMethod("OPTIONS", "/custom", write("options"))
+  rec := serve(h, "OPTIONS", "/items")
+  if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "GET, POST, OPTIONS" {
+    t.Errorf("got %d Allow %q, want 204 Allow %q", rec.Code, rec.Header().Get("Allow"), "GET, POST, OPTIONS")
+  }
+  if rec := serve(h, "OPTIONS", "/custom"); rec.Body.String() != "options" {
+    t.Errorf("got %q, want the explicit OPTIONS route", rec.Body.String())
+  }
+  if rec := serve(h, "OPTIONS", "/none"); rec.Code == http.StatusNoContent {
+    t.Error("unmatched path answered with 204")
+  }
+}
+
+func TestAddHandler(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddHandler("/users/(\\d+)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("user " + SubmatchesFromContext(r)[0]))
+  }))
+  if body := serve(h, "GET", "/users/42").Body.String(); body != "user 42" {
+    t.Errorf("got %q, want %q", body, "user 42")
+  }
+}
+
+func TestRecover(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Recover = true
+  h.Add("/panic", func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic("boom")
+  })
+  h.Add("/ok", write("ok"))
+  if rec := serve(h, "GET", "/panic"); rec.Code != http.StatusInternalServerError {
+    t.Errorf("got %d, want 500", rec.Code)
+  }
+  if body := serve(h, "GET", "/ok").Body.String(); body != "ok" {
+    t.Errorf("got %q after a recovered panic", body)
+  }
+}
+
+func TestRecoverHandler(t *testing.T) {
+  h := NewRegexpHandler()
+  var got interface{}
+  h.RecoverHandler = func(w http.ResponseWriter, r *http.Request, v interface{}) {
+    got = v
+    http.Error(w, "recovered", http.StatusTeapot)
+  }
+  h.Add("/panic", func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic("boom")
+  })
+  if rec := serve(h, "GET", "/panic"); rec.Code != http.StatusTeapot || got != "boom" {
+    t.Errorf("got %d with %v, want RecoverHandler to answer", rec.Code, got)
+  }
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Recover = true
+  h.Add("/abort", func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic(http.ErrAbortHandler)
+  })
+  defer func() {
+    if v := recover(); v != http.ErrAbortHandler {
+      t.Errorf("got %v, want http.ErrAbortHandler to be re-panicked", v)
+    }
+  }()
+  serve(h, "GET", "/abort")
+}
+
+func TestRouteRecover(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Recover = true
+  h.Add("/prod", func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic("secret detail")
+  })
+  h.AddRecover("/debug", func(w http.ResponseWriter, r *http.Request, v interface{}) {
+    http.Error(w, fmt.Sprint("panic: ", v), http.StatusInternalServerError)
+  }, func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic("secret detail")
+  })
+  h.Add("/abort", func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic(http.ErrAbortHandler)
+  }).Recover(func(w http.ResponseWriter, r *http.Request, v interface{}) {
+    t.Error("the route's recover handler got http.ErrAbortHandler")
+  })
+  if rec := serve(h, "GET", "/debug"); rec.Code != http.StatusInternalServerError || rec.Body.String() != "panic: secret detail\n" {
+    t.Errorf("debug: got %d %q, want the panic detail", rec.Code, rec.Body.String())
+  }
+  if rec := serve(h, "GET", "/prod"); rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "secret") {
+    t.Errorf("prod: got %d %q, want a bland 500", rec.Code, rec.Body.String())
+  }
+  h.Recover = false
+  if rec := serve(h, "GET", "/debug"); rec.Body.String() != "panic: secret detail\n" {
+    t.Errorf("got %q without Recover, want the route's handler to apply", rec.Body.String())
+  }
+  defer func() {
+    if v := recover(); v != http.ErrAbortHandler {
+      t.Errorf("got %v, want http.ErrAbortHandler to be re-panicked", v)
+    }
+  }()
+  serve(h, "GET", "/abort")
+}
+
+func TestPathFunc(t *testing.T) {
+  h := NewRegexpHandler()
+  h.PathFunc = func(r *http.Request) string {
+    return r.URL.EscapedPath()
+  }
+  h.Add("/files/([^/]+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(m[0]))
+  })
+  if body := serve(h, "GET", "/files/a%2Fb").Body.String(); body != "a%2Fb" {
+    t.Errorf("got %q, want the encoded slash to be matched literally", body)
+  }
+  if body := serve(h, "GET", "/files/a/b").Body.String(); body != "" {
+    t.Errorf("got %q, want a real slash not to match", body)
+  }
+}
+
+// observation records a call of Observe.
+type observation struct {
+  pattern  string
+  status   int
+  duration time.Duration
+}
+
+func TestObserve(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []observation
+  h.Observe = func(pattern string, status int, duration time.Duration) {
+    got = append(got, observation{pattern, status, duration})
+  }
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    time.Sleep(time.Millisecond)
+    w.WriteHeader(http.StatusCreated)
+  })
+  h.Add("/ok", write("ok"))
+  serve(h, "GET", "/users/1")
+  serve(h, "GET", "/ok")
+  serve(h, "GET", "/none")
+  if len(got) != 3 {
+    t.Fatalf("got %d calls, want 3", len(got))
+  }
+  if got[0].pattern != "/users/(\\d+)" || got[0].status != http.StatusCreated || got[0].duration < time.Millisecond {
+    t.Errorf("got %+v for /users/1", got[0])
+  }
+  if got[1].pattern != "/ok" || got[1].status != http.StatusOK {
+    t.Errorf("got %+v for /ok, want the default status 200", got[1])
+  }
+  if got[2].pattern != "" {
+    t.Errorf("got pattern %q for an unmatched request", got[2].pattern)
+  }
+}
+
+func TestInsert(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  h.Add(".*", write("catch-all"))
+  if err := h.Insert(1, "/b", write("b")); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.AddFront("/a", write("front")); err != nil {
+    t.Fatal(err)
+  }
+  for path, want := range map[string]string{"/a": "front", "/b": "b", "/c": "catch-all"} {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+  for _, index := range []int{-1, 5} {
+    if err := h.Insert(index, "/x", write("x")); err == nil {
+      t.Errorf("Insert(%d) with 4 routes returned nil error", index)
+    }
+  }
+  if err := h.Insert(4, "/d", write("d")); err != nil {
+    t.Errorf("Insert at the end: %v", err)
+  }
+}
+
+func TestMatchSpecific(t *testing.T) {
+  for _, reversed := range []bool{false, true} {
+    h := NewRegexpHandler()
+    h.MatchMode = MatchSpecific
+    routes := []struct{ expression, body string }{
+      {"/users/([^/]+)", "user"},
+      {"/users/new", "new"},
+      {"/(.*)", "any"},
+    }
+    if reversed {
+      routes[0], routes[2] = routes[2], routes[0]
+    }
+    for _, rt := range routes {
+      h.Add(rt.expression, write(rt.body))
+    }
+    for path, want := range map[string]string{"/users/new": "new", "/users/42": "user", "/other": "any"} {
+      if body := serve(h, "GET", path).Body.String(); body != want {
+        t.Errorf("reversed %v, %s: got %q, want %q", reversed, path, body, want)
+      }
+    }
+  }
+}
+
+func TestMatchSpecificTie(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MatchMode = MatchSpecific
+  h.Add("/a/(x|y)", write("first"))
+  h.Add("/a/[xy]", write("second"))
+  if body := serve(h, "GET", "/a/x").Body.String(); body != "first" {
+    t.Errorf("got %q, want ties broken by registration order", body)
+  }
+}
+
+func TestAutoHEAD(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AutoHEAD = true
+  h.AddMethod("GET", "/page", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Header().Set("Content-Length", "5")
+    w.Header().Set("X-Page", "1")
+    w.WriteHeader(http.StatusAccepted)
+    w.Write([]byte("hello"))
+  })
+  rec := serve(h, "HEAD", "/page")
+  if rec.Code != http.StatusAccepted || rec.Body.Len() != 0 {
+    t.Errorf("got %d %q, want 202 without a body", rec.Code, rec.Body.String())
+  }
+  if rec.Header().Get("Content-Length") != "5" || rec.Header().Get("X-Page") != "1" {
+    t.Errorf("got header %v, want the GET route's header", rec.Header())
+  }
+}
+
+func TestAutoHEADOff(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("GET", "/page", write("hello"))
+  if rec := serve(h, "HEAD", "/page"); rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+    t.Errorf("got %q without AutoHEAD, want no route to serve HEAD", rec.Body.String())
+  }
+}
+
+func TestAddInt(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []int
+  h.AddInt("/items/(\\w*)/(\\d+)", func(w http.ResponseWriter, r *http.Request, ids []int) {
+    got = ids
+  })
+  if rec := serve(h, "GET", "/items/12/34"); rec.Code != http.StatusOK || fmt.Sprint(got) != "[12 34]" {
+    t.Errorf("got %d %v, want [12 34]", rec.Code, got)
+  }
+  for _, path := range []string{"/items/abc/1", "/items//1", "/items/99999999999999999999/1"} {
+    got = nil
+    if rec := serve(h, "GET", path); rec.Code != http.StatusBadRequest || got != nil {
+      t.Errorf("%s: got %d, called with %v; want 400", path, rec.Code, got)
+    }
+  }
+}
+
+func TestDecodeSubmatches(t *testing.T) {
+  h := NewRegexpHandler()
+  h.DecodeSubmatches = true
+  h.PathFunc = func(r *http.Request) string {
+    return r.RequestURI
+  }
+  var got string
+  h.Add("/files/(.+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = m[0]
+  })
+  for path, want := range map[string]string{
+    "/files/a%20b": "a b",
+    "/files/a%2Fb": "a/b",
+  } {
+    got = ""
+    if rec := serve(h, "GET", path); rec.Code != http.StatusOK || got != want {
+      t.Errorf("%s: got %d %q, want %q", path, rec.Code, got, want)
+    }
+  }
+  // httptest.NewRequest rejects malformed escapes, so the URI is set directly.
+  r := request("GET", "/files/x", "")
+  r.RequestURI = "/files/%zz"
+  got = ""
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if rec.Code != http.StatusBadRequest || got != "" {
+    t.Errorf("got %d, called with %q; want 400", rec.Code, got)
+  }
+}
+
+func TestValid(t *testing.T) {
+  for _, expression := range []string{"/", "/users/(\\d+)", "/a|/b"} {
+    if err := Valid(expression); err != nil {
+      t.Errorf("Valid(%q) = %v", expression, err)
+    }
+  }
+  if err := Valid("/users/["); err == nil || !strings.Contains(err.Error(), "missing closing ]") {
+    t.Errorf("Valid(\"/users/[\") = %v, want a compile error", err)
+  }
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MaxBodyBytes = 5
+  var err error
+  h.Add("/upload", func(w http.ResponseWriter, r *http.Request, m []string) {
+    _, err = io.ReadAll(r.Body)
+  })
+  h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("hello")))
+  if err != nil {
+    t.Errorf("reading a body at the limit: %v", err)
+  }
+  h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("hello, world")))
+  if err == nil {
+    t.Error("reading a body over the limit succeeded")
+  }
+}
+
+func TestClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.CaseInsensitive = true
+  h.Add("/a", write("a"))
+  c := h.Clone()
+  c.Add("/b", write("b"))
+  c.Remove("/a")
+  if h.Len() != 1 || c.Len() != 1 {
+    t.Fatalf("got %d routes in the original and %d in the clone, want 1 and 1", h.Len(), c.Len())
+  }
+  if body := serve(h, "GET", "/A").Body.String(); body != "a" {
+    t.Errorf("original: got %q, want a", body)
+  }
+  if body := serve(c, "GET", "/B").Body.String(); body != "b" {
+    t.Errorf("clone: got %q, want b with the copied configuration", body)
+  }
+}
+
+func TestMaxPathLen(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MaxPathLen = 10
+  called := false
+  h.Add(".*", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  if serve(h, "GET", "/123456789"); !called {
+    t.Error("a path at the limit was rejected")
+  }
+  called = false
+  if rec := serve(h, "GET", "/"+strings.Repeat("a", 10)); rec.Code != http.StatusRequestURITooLong || called {
+    t.Errorf("got %d, called %v; want 414 without calling the route", rec.Code, called)
+  }
+}
+
+func TestAddAll(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddAll([]RouteSpec{
+    {Expression: "/a", Func: write("a")},
+    {Expression: "/b(", Func: write("b")},
+  }); err == nil || !strings.Contains(err.Error(), "route 1") {
+    t.Errorf("got %v, want an error naming route 1", err)
+  }
+  if h.Len() != 0 {
+    t.Errorf("got %d routes after a failed AddAll, want 0", h.Len())
+  }
+  if err := h.AddAll([]RouteSpec{
+    {Expression: "/a", Method: "POST", Func: write("post")},
+    {Expression: "/a", Func: write("any")},
+  }); err != nil {
+    t.Fatal(err)
+  }
+  if body := serve(h, "POST", "/a").Body.String(); body != "post" {
+    t.Errorf("POST: got %q, want post", body)
+  }
+  if body := serve(h, "GET", "/a").Body.String(); body != "any" {
+    t.Errorf("GET: got %q, want any", body)
+  }
+}
+
+func TestNotFoundHandler(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("GET", "/only-get", MethodNotAllowedHandler)
+  h.Add(".*", NotFoundHandler)
+  for path, want := range map[string]int{"/only-get": http.StatusMethodNotAllowed, "/missing": http.StatusNotFound} {
+    rec := serve(h, "GET", path)
+    if rec.Code != want || strings.TrimSpace(rec.Body.String()) != http.StatusText(want) {
+      t.Errorf("%s: got %d %q, want %d", path, rec.Code, rec.Body.String(), want)
+    }
+  }
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+  h := NewRegexpHandler()
+  called := false
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if r.Header.Get("Authorization") == "" {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+      }
+      next.ServeHTTP(w, r)
+    })
+  })
+  h.Add("/private", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  if rec := serve(h, "GET", "/private"); rec.Code != http.StatusUnauthorized || called {
+    t.Errorf("got %d, called %v; want 401 without calling the route", rec.Code, called)
+  }
+  r := request("GET", "/private", "")
+  r.Header.Set("Authorization", "token")
+  h.ServeHTTP(httptest.NewRecorder(), r)
+  if !called {
+    t.Error("the route wasn't called for an authorized request")
+  }
+}
+
+func TestMatch(t *testing.T) {
+  h := NewRegexpHandler()
+  called := false
+  user := h.AddMethod("GET", "/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  rt, m, ok := h.Match(request("GET", "/users/42", ""))
+  if !ok || rt != user || fmt.Sprint(m) != "[42]" {
+    t.Errorf("got %v %v %v, want the user route with [42]", rt, m, ok)
+  }
+  if _, _, ok := h.Match(request("POST", "/users/42", "")); ok {
+    t.Error("matched a request whose method the route doesn't allow")
+  }
+  if _, _, ok := h.Match(request("GET", "/missing", "")); ok {
+    t.Error("matched a request no route matches")
+  }
+  if called {
+    t.Error("Match called the route function")
+  }
+}
+
+func TestAddContentType(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddContentType("application/json", "/default", write("{}"))
+  h.AddContentType("application/json", "/override", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Header().Set("Content-Type", "text/csv")
+    w.Write([]byte("a,b"))
+  })
+  if got := serve(h, "GET", "/default").Header().Get("Content-Type"); got != "application/json" {
+    t.Errorf("got Content-Type %q, want application/json", got)
+  }
+  if got := serve(h, "GET", "/override").Header().Get("Content-Type"); got != "text/csv" {
+    t.Errorf("got Content-Type %q, want the route's text/csv", got)
+  }
+}
+
+func TestAddFinal(t *testing.T) {
+  h := NewRegexpHandler()
+  var log []string
+  h.AddFinal(func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, fmt.Sprint("first", m))
+  })
+  h.AddFinal(func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, "second")
+    w.WriteHeader(http.StatusGone)
+  })
+  h.AddFinal(func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, "third")
+  })
+  // Routes registered after the finals still take precedence over them.
+  h.Add("/a", write("a"))
+  if body := serve(h, "GET", "/a").Body.String(); body != "a" || len(log) != 0 {
+    t.Errorf("got %q with finals %v, want the route only", body, log)
+  }
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusGone {
+    t.Errorf("got %d, want the second final's 410", rec.Code)
+  }
+  if got := fmt.Sprint(log); got != "[first[] second]" {
+    t.Errorf("got finals %s, want them to stop after the first write", got)
+  }
+}
+
+func TestAddFinalNoWrite(t *testing.T) {
+  h := NewRegexpHandler()
+  h.NotFound = http.HandlerFunc(http.NotFound)
+  h.AddFinal(func(w http.ResponseWriter, r *http.Request, m []string) {})
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusNotFound {
+    t.Errorf("got %d, want NotFound to serve the request when no final writes", rec.Code)
+  }
+}
+
+func TestRejectDuplicates(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("first"))
+  h.Add("/a", write("second"))
+  if h.Len() != 2 {
+    t.Errorf("got %d routes, want duplicates to be allowed by default", h.Len())
+  }
+
+  h = NewRegexpHandler()
+  h.RejectDuplicates = true
+  if err := h.AddE("/a", write("first")); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.AddE("/a", write("second")); !errors.Is(err, ErrDuplicateRoute) {
+    t.Errorf("got %v, want ErrDuplicateRoute", err)
+  }
+  if err := h.AddE("/b", write("b")); err != nil {
+    t.Errorf("a different expression was rejected: %v", err)
+  }
+  h.AddMethod("POST", "/a", write("post"))
+  defer func() {
+    if recover() == nil {
+      t.Error("Add didn't panic on a duplicate")
+    }
+  }()
+  h.Add("/a", write("third"))
+}
+
+func TestAddQuery(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddQuery("/search", map[string]string{"q": "", "sort": "date"}, write("by date"))
+  h.AddQuery("/search", map[string]string{"q": ""}, write("any"))
+  h.Add("/search", write("fallback"))
+  for path, want := range map[string]string{
+    "/search?q=go&sort=date&page=2": "by date",
+    "/search?sort=name&q=go":        "any",
+    "/search?q=":                    "any",
+    "/search?sort=date":             "fallback",
+  } {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+}
+
+func TestWithRouteTimeout(t *testing.T) {
+  h := NewRegexpHandler()
+  var err error
+  h.Add("/slow", WithRouteTimeout(10*time.Millisecond, func(w http.ResponseWriter, r *http.Request, m []string) {
+    select {
+    case <-r.Context().Done():
+      err = r.Context().Err()
+    case <-time.After(5 * time.Second):
+    }
+  }))
+  start := time.Now()
+  serve(h, "GET", "/slow")
+  if !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("got %v, want the route's context to expire", err)
+  }
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Errorf("the request took %v, want the route to return at the timeout", elapsed)
+  }
+}
+
+func TestAddTimeoutCancelsContext(t *testing.T) {
+  h := NewRegexpHandler()
+  done := make(chan error, 1)
+  h.AddTimeout("/slow", 10*time.Millisecond, func(w http.ResponseWriter, r *http.Request, m []string) {
+    <-r.Context().Done()
+    done <- r.Context().Err()
+  })
+  serve(h, "GET", "/slow")
+  select {
+  case err := <-done:
+    if !errors.Is(err, context.DeadlineExceeded) {
+      t.Errorf("got %v, want context.DeadlineExceeded", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Error("the route's context wasn't canceled")
+  }
+}
+
+func TestAddLimit(t *testing.T) {
+  h := NewRegexpHandler()
+  var inFlight, max int32
+  release := make(chan struct{})
+  h.AddLimit("/work", 2, func(w http.ResponseWriter, r *http.Request, m []string) {
+    n := atomic.AddInt32(&inFlight, 1)
+    for {
+      old := atomic.LoadInt32(&max)
+      if n <= old || atomic.CompareAndSwapInt32(&max, old, n) {
+        break
+      }
+    }
+    <-release
+    atomic.AddInt32(&inFlight, -1)
+  })
+  var wg sync.WaitGroup
+  for i := 0; i < 6; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      serve(h, "GET", "/work")
+    }()
+  }
+  // Give the requests time to pile up behind the limit before releasing them.
+  time.Sleep(50 * time.Millisecond)
+  close(release)
+  wg.Wait()
+  if max != 2 {
+    t.Errorf("got at most %d concurrent calls, want 2", max)
+  }
+}
+
+func TestAddLimitReject(t *testing.T) {
+  h := NewRegexpHandler()
+  h.LimitMode = LimitReject
+  release, started := make(chan struct{}), make(chan struct{})
+  h.AddLimit("/work", 1, func(w http.ResponseWriter, r *http.Request, m []string) {
+    close(started)
+    <-release
+  })
+  done := make(chan struct{})
+  go func() {
+    serve(h, "GET", "/work")
+    close(done)
+  }()
+  <-started
+  if rec := serve(h, "GET", "/work"); rec.Code != http.StatusServiceUnavailable {
+    t.Errorf("got %d, want 503 beyond the limit", rec.Code)
+  }
+  close(release)
+  <-done
+}
+
+func TestAddLimitClone(t *testing.T) {
+  h := NewRegexpHandler()
+  release, started := make(chan struct{}), make(chan struct{})
+  h.AddLimit("/work", 1, func(w http.ResponseWriter, r *http.Request, m []string) {
+    close(started)
+    <-release
+  })
+  c := h.Clone()
+  c.LimitMode = LimitReject
+  done := make(chan struct{})
+  go func() {
+    serve(c, "GET", "/work")
+    close(done)
+  }()
+  <-started
+  if rec := serve(c, "GET", "/work"); rec.Code != http.StatusServiceUnavailable {
+    t.Errorf("got %d, want 503 beyond the limit with the clone's LimitMode", rec.Code)
+  }
+  close(release)
+  <-done
+}
+
+func TestAddLimitReleasesOnPanic(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Recover = true
+  h.AddLimit("/panic", 1, func(w http.ResponseWriter, r *http.Request, m []string) {
+    panic("boom")
+  })
+  for i := 0; i < 2; i++ {
+    done := make(chan struct{})
+    go func() {
+      serve(h, "GET", "/panic")
+      close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+      t.Fatal("a panic didn't release the limit")
+    }
+  }
+}
+
+func TestAddLimitInvalid(t *testing.T) {
+  for _, n := range []int{0, -1} {
+    func() {
+      defer func() {
+        if err, ok := recover().(error); !ok || !strings.Contains(err.Error(), "concurrency limit") {
+          t.Errorf("AddLimit(%d): got %v, want a panic naming the limit", n, err)
+        }
+      }()
+      NewRegexpHandler().AddLimit("/a", n, write("a"))
+    }()
+  }
+}
+
+func TestAddIndexed(t *testing.T) {
+  h := NewRegexpHandler()
+  var got [][2]int
+  var gotPath string
+  h.AddIndexed("/x(/y*)?", func(w http.ResponseWriter, r *http.Request, matches [][2]int, path string) {
+    got, gotPath = matches, path
+  })
+  serve(h, "GET", "/x")
+  if fmt.Sprint(got) != "[[-1 -1]]" || gotPath != "/x" {
+    t.Errorf("absent group: got %v in %q, want [[-1 -1]]", got, gotPath)
+  }
+  serve(h, "GET", "/x/")
+  if fmt.Sprint(got) != "[[2 3]]" || gotPath[got[0][0]:got[0][1]] != "/" {
+    t.Errorf("present group: got %v in %q, want [[2 3]]", got, gotPath)
+  }
+  // With Add, both requests look the same apart from the slash.
+  var m0 []string
+  h2 := NewRegexpHandler()
+  h2.Add("/x(/y*)?", func(w http.ResponseWriter, r *http.Request, m []string) {
+    m0 = m
+  })
+  serve(h2, "GET", "/x")
+  if fmt.Sprintf("%q", m0) != `[""]` {
+    t.Errorf("Add: got %q, want an empty submatch", m0)
+  }
+}
+
+func TestAddIndexedClone(t *testing.T) {
+  h := NewRegexpHandler()
+  var got [][2]int
+  h.AddIndexed("/x(/y*)?", func(w http.ResponseWriter, r *http.Request, matches [][2]int, path string) {
+    got = matches
+  })
+  c := h.Clone()
+  c.AnchorMode = AnchorStart
+  if err := c.Reanchor(); err != nil {
+    t.Fatal(err)
+  }
+  serve(c, "GET", "/x/z")
+  if fmt.Sprint(got) != "[[2 3]]" {
+    t.Errorf("got %v, want [[2 3]] from the clone's reanchored expression", got)
+  }
+}
+
+func TestMethodCaseInsensitive(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("post", "/a", write("post"))
+  h.AddMethod("PURGE", "/a", write("purge"))
+  for method, want := range map[string]string{"post": "post", "POST": "post", "Purge": "purge"} {
+    // httptest.NewRequest keeps the method as given.
+    if body := serve(h, method, "/a").Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", method, body, want)
+    }
+  }
+}
+
+func TestDrain(t *testing.T) {
+  h := NewRegexpHandler()
+  var observed []observation
+  h.Observe = func(pattern string, status int, duration time.Duration) {
+    observed = append(observed, observation{pattern: pattern, status: status})
+  }
+  var spans []string
+  h.StartSpan = func(r *http.Request, pattern string) (context.Context, func(int)) {
+    return nil, func(status int) { spans = append(spans, fmt.Sprint(pattern, status)) }
+  }
+  var log []string
+  h.Use(record(&log, "mw"))
+  h.Add("/a", write("a"))
+  h.Drain()
+  rec := serve(h, "GET", "/a")
+  if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+    t.Errorf("got %d with Retry-After %q, want 503 while draining", rec.Code, rec.Header().Get("Retry-After"))
+  }
+  if len(log) != 0 {
+    t.Errorf("middleware ran for a refused request: %v", log)
+  }
+  if len(observed) != 1 || observed[0].status != http.StatusServiceUnavailable || observed[0].pattern != "" {
+    t.Errorf("got observations %v, want the 503", observed)
+  }
+  if fmt.Sprint(spans) != "[503]" {
+    t.Errorf("got spans %v, want the 503", spans)
+  }
+  h.Undrain()
+  if body := serve(h, "GET", "/a").Body.String(); body != "a" {
+    t.Errorf("got %q after Undrain, want a", body)
+  }
+}
+
+func TestAddScheme(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddScheme("https", "/login", write("https"))
+  h.Add("/login", write("plain"))
+  secure := request("GET", "/login", "")
+  secure.TLS = &tls.ConnectionState{}
+  forwarded := request("GET", "/login", "")
+  forwarded.Header.Set("X-Forwarded-Proto", "https")
+  for _, test := range []struct {
+    name    string
+    r       *http.Request
+    trusted bool
+    want    string
+  }{
+    {"TLS", secure, false, "https"},
+    {"plain", request("GET", "/login", ""), false, "plain"},
+    {"untrusted header", forwarded, false, "plain"},
+    {"trusted header", forwarded, true, "https"},
+  } {
+    h.TrustForwardedProto = test.trusted
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, test.r)
+    if body := rec.Body.String(); body != test.want {
+      t.Errorf("%s: got %q, want %q", test.name, body, test.want)
+    }
+  }
+}
+
+func TestAddSchemeClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddScheme("https", "/login", write("https"))
+  c := h.Clone()
+  c.TrustForwardedProto = true
+  r := request("GET", "/login", "")
+  r.Header.Set("X-Forwarded-Proto", "https")
+  rec := httptest.NewRecorder()
+  c.ServeHTTP(rec, r)
+  if body := rec.Body.String(); body != "https" {
+    t.Errorf("clone: got %q, want https with the clone's TrustForwardedProto", body)
+  }
+  rec = httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if body := rec.Body.String(); body != "" {
+    t.Errorf("original: got %q, want no match", body)
+  }
+}
+
+func TestAddErr(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddErr("/fail", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    return errors.New("database unavailable")
+  })
+  h.AddErr("/written", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    w.WriteHeader(http.StatusAccepted)
+    return errors.New("too late")
+  })
+  h.AddErr("/ok", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    w.Write([]byte("ok"))
+    return nil
+  })
+  rec := serve(h, "GET", "/fail")
+  if rec.Code != http.StatusInternalServerError || strings.TrimSpace(rec.Body.String()) != "database unavailable" {
+    t.Errorf("got %d %q, want the default 500 with the error's text", rec.Code, rec.Body.String())
+  }
+  var handled []error
+  h.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+    handled = append(handled, err)
+    http.Error(w, "custom", http.StatusBadGateway)
+  }
+  if rec := serve(h, "GET", "/fail"); rec.Code != http.StatusBadGateway {
+    t.Errorf("got %d, want ErrorHandler's 502", rec.Code)
+  }
+  if rec := serve(h, "GET", "/written"); rec.Code != http.StatusAccepted || rec.Body.Len() != 0 {
+    t.Errorf("got %d %q, want the route's own response only", rec.Code, rec.Body.String())
+  }
+  if rec := serve(h, "GET", "/ok"); rec.Body.String() != "ok" {
+    t.Errorf("got %q, want ok", rec.Body.String())
+  }
+  if len(handled) != 1 {
+    t.Errorf("got %d errors handled, want 1", len(handled))
+  }
+}
+
+func TestAddErrClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddErr("/fail", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    return errors.New("fail")
+  })
+  c := h.Clone()
+  c.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+    http.Error(w, "clone", http.StatusTeapot)
+  }
+  if rec := serve(c, "GET", "/fail"); rec.Code != http.StatusTeapot {
+    t.Errorf("clone: got %d, want the clone's ErrorHandler's 418", rec.Code)
+  }
+  if rec := serve(h, "GET", "/fail"); rec.Code != http.StatusInternalServerError {
+    t.Errorf("original: got %d, want the default 500", rec.Code)
+  }
+}
+
+func TestCleanPath(t *testing.T) {
+  h := NewRegexpHandler()
+  h.CleanPath = true
+  var got string
+  h.Add("/users/(\\d+)/?", func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = r.URL.Path
+  })
+  for path, want := range map[string]string{
+    "/users//42":     "/users/42",
+    "/users/x/../42": "/users/42",
+    "/./users/42":    "/users/42",
+    "/users/42/":     "/users/42/",
+    "/users//42//":   "/users/42/",
+  } {
+    got = ""
+    if serve(h, "GET", path); got != want {
+      t.Errorf("%s: the route saw %q, want %q", path, got, want)
+    }
+  }
+}
+
+func TestRedirectCleanPath(t *testing.T) {
+  h := NewRegexpHandler()
+  h.CleanPath, h.RedirectCleanPath = true, true
+  called := false
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  rec := serve(h, "GET", "/users//42?x=1")
+  if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/users/42?x=1" || called {
+    t.Errorf("got %d to %q, want a 301 to the cleaned path", rec.Code, rec.Header().Get("Location"))
+  }
+  if serve(h, "POST", "/users//42"); !called {
+    t.Error("a POST request for an unclean path wasn't served")
+  }
+}
+
+func TestAddMethods(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethods([]string{"GET", "HEAD"}, "/a", write("read"))
+  h.AddMethods(nil, "/a", write("any"))
+  for method, want := range map[string]string{"GET": "read", "HEAD": "read", "POST": "any"} {
+    if body := serve(h, method, "/a").Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", method, body, want)
+    }
+  }
+}
+
+func TestWriteNotFound(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a"))
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+    t.Errorf("got %d %q, want the old empty response by default", rec.Code, rec.Body.String())
+  }
+  h.WriteNotFound = true
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusNotFound {
+    t.Errorf("got %d, want 404", rec.Code)
+  }
+  h.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusTeapot)
+  })
+  if rec := serve(h, "GET", "/b"); rec.Code != http.StatusTeapot {
+    t.Errorf("got %d, want NotFound to take precedence", rec.Code)
+  }
+}
+
+func TestAddRaw(t *testing.T) {
+  h := NewRegexpHandler()
+  if _, err := h.AddRaw("users/\\d+", write("raw")); err != nil {
+    t.Fatal(err)
+  }
+  h.Add("/items/\\d+", write("anchored"))
+  for path, want := range map[string]string{
+    "/api/users/42/posts": "raw",
+    "/items/42":           "anchored",
+    "/api/items/42":       "",
+    "/items/42/x":         "",
+  } {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+  if _, err := h.AddRaw("users/(", write("bad")); err == nil {
+    t.Error("AddRaw accepted an invalid pattern")
+  }
+}
+
+func TestCoverage(t *testing.T) {
+  h := NewRegexpHandler()
+  h.TrackCoverage = true
+  h.Add("/users/.*", write("broad"))
+  h.Add("/users/(\\d+)", write("shadowed"))
+  h.Add("/other", write("other"))
+  serve(h, "GET", "/users/1")
+  serve(h, "GET", "/users/2")
+  serve(h, "GET", "/missing")
+  got := h.Coverage()
+  if got["/users/.*"] != 2 || got["/users/(\\d+)"] != 0 || got["/other"] != 0 || len(got) != 3 {
+    t.Errorf("got %v, want the broad route hit twice and the others never", got)
+  }
+}
+
+func TestMethodOverride(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("PUT", "/items/(\\d+)", write("put"))
+  h.AddMethod("POST", "/items/(\\d+)", write("post"))
+  override := func(header, form string) *http.Request {
+    r := httptest.NewRequest("POST", "/items/1", strings.NewReader(form))
+    if form != "" {
+      r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+    if header != "" {
+      r.Header.Set("X-HTTP-Method-Override", header)
+    }
+    return r
+  }
+  for _, test := range []struct {
+    name    string
+    r       *http.Request
+    enabled bool
+    want    string
+  }{
+    {"header", override("put", ""), true, "put"},
+    {"form", override("", "_method=PUT"), true, "put"},
+    {"header before form", override("PUT", "_method=DELETE"), true, "put"},
+    {"unsafe method", override("TRACE", ""), true, "post"},
+    {"disabled", override("PUT", ""), false, "post"},
+  } {
+    h.MethodOverride = test.enabled
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, test.r)
+    if body := rec.Body.String(); body != test.want {
+      t.Errorf("%s: got %q, want %q", test.name, body, test.want)
+    }
+  }
+}
+
+func TestMethodOverrideLeavesOtherBodies(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MethodOverride = true
+  var part string
+  h.AddMethod("POST", "/upload", func(w http.ResponseWriter, r *http.Request, m []string) {
+    mr, err := r.MultipartReader()
+    if err != nil {
+      t.Fatal(err)
+    }
+    p, err := mr.NextPart()
+    if err != nil {
+      t.Fatal(err)
+    }
+    part = p.FormName()
+  })
+  body := "--b\r\nContent-Disposition: form-data; name=\"_method\"\r\n\r\nPUT\r\n--b--\r\n"
+  r := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+  r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+  h.ServeHTTP(httptest.NewRecorder(), r)
+  if part != "_method" {
+    t.Errorf("got part %q, want the multipart body to reach the route unread", part)
+  }
+}
+
+func TestMethodOverrideMaxBodyBytes(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MethodOverride = true
+  h.MaxBodyBytes = 16
+  h.AddMethod("PUT", "/items", write("put"))
+  h.AddMethod("POST", "/items", write("post"))
+  r := httptest.NewRequest("POST", "/items", strings.NewReader("padding="+strings.Repeat("x", 100)+"&_method=PUT"))
+  r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if rec.Body.String() != "post" {
+    t.Errorf("got %q, want the override beyond MaxBodyBytes to be ignored", rec.Body.String())
+  }
+}
+
+func TestMethodOverrideMatchLeavesBody(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MethodOverride = true
+  h.AddMethod("PUT", "/items", write("put"))
+  post := h.AddMethod("POST", "/items", write("post"))
+  form := func() *http.Request {
+    r := httptest.NewRequest("POST", "/items", strings.NewReader("_method=PUT"))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    return r
+  }
+  r := form()
+  if rt, _, _ := h.Match(r); rt != post {
+    t.Errorf("Match: got %v, want the POST route, as the form isn't read", rt)
+  }
+  if explanation := h.Explain(r); !strings.HasPrefix(explanation, "POST ") {
+    t.Errorf("Explain: got %q, want the POST method", explanation)
+  }
+  if body, _ := io.ReadAll(r.Body); string(body) != "_method=PUT" {
+    t.Errorf("got body %q after Match and Explain, want it unread", body)
+  }
+  r = form()
+  r.Header.Set("X-HTTP-Method-Override", "PUT")
+  if rt, _, _ := h.Match(r); rt == post {
+    t.Error("Match ignored the X-HTTP-Method-Override header")
+  }
+  rec := httptest.NewRecorder()
+  if h.ServeHTTP(rec, form()); rec.Body.String() != "put" {
+    t.Errorf("ServeHTTP: got %q, want the form's override", rec.Body.String())
+  }
+}
+
+func TestHandle(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Handle("/users/(\\d+)", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprint(w, "handle", SubmatchesFromContext(r))
+  }))
+  h.HandleFunc("/users/.*", func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprint(w, "func", SubmatchesFromContext(r))
+  })
+  for path, want := range map[string]string{"/users/42": "handle[42]", "/users/bob": "func[]"} {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+}
+
+func TestDispatch(t *testing.T) {
+  h := NewRegexpHandler()
+  var log []string
+  h.Use(record(&log, "mw"))
+  h.AddMethod("POST", "/echo", func(w http.ResponseWriter, r *http.Request, m []string) {
+    io.Copy(w, r.Body)
+  })
+  rec, ok := h.Dispatch("POST", "/echo?x=1", strings.NewReader("body"))
+  if !ok || rec.Body.String() != "body" {
+    t.Errorf("got %v %q, want the echoed body", ok, rec.Body.String())
+  }
+  if len(log) != 1 {
+    t.Errorf("got middleware log %v, want the middleware to run", log)
+  }
+  h.WriteNotFound = true
+  if rec, ok := h.Dispatch("GET", "/missing", nil); ok || rec.Code != http.StatusNotFound {
+    t.Errorf("got %v %d, want no match and 404", ok, rec.Code)
+  }
+}
+
+func TestAnchorEnd(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AnchorMode = AnchorEnd
+  h.Add("\\.json", write("json"))
+  for path, want := range map[string]string{"/api/v1/data.json": "json", "/data.json.bak": "", "/data.jsonx": ""} {
+    if body := serve(h, "GET", path).Body.String(); body != want {
+      t.Errorf("%s: got %q, want %q", path, body, want)
+    }
+  }
+}
+
+func TestMaxURILen(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MaxURILen = 64
+  called := false
+  h.Add("/search", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  if rec := serve(h, "GET", "/search?q="+strings.Repeat("a", 100)); rec.Code != http.StatusRequestURITooLong || called {
+    t.Errorf("got %d, called %v; want 414 without calling the route", rec.Code, called)
+  }
+  if rec := serve(h, "GET", "/search?q="+strings.Repeat("a", 40)); rec.Code != http.StatusOK || !called {
+    t.Errorf("got %d, called %v; want a URI under the limit served", rec.Code, called)
+  }
+}
+
+func TestMoveToFront(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/users/.*", write("broad"))
+  h.Add("/other", write("other"))
+  h.Add("/users/(\\d+)", write("specific"))
+  if !h.MoveToFront("/users/(\\d+)") {
+    t.Fatal("MoveToFront didn't find the route")
+  }
+  if body := serve(h, "GET", "/users/1").Body.String(); body != "specific" {
+    t.Errorf("got %q, want the promoted route", body)
+  }
+  var order []string
+  for _, info := range h.Routes() {
+    order = append(order, info.Expression)
+  }
+  if got := fmt.Sprint(order); got != `[/users/(\d+) /users/.* /other]` {
+    t.Errorf("got order %s", got)
+  }
+  if h.MoveToFront("/missing") {
+    t.Error("MoveToFront found a missing route")
+  }
+}
+
+func TestSwap(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/users/.*", write("broad"))
+  h.Add("/users/(\\d+)", write("specific"))
+  if err := h.Swap(0, 1); err != nil {
+    t.Fatal(err)
+  }
+  if body := serve(h, "GET", "/users/1").Body.String(); body != "specific" {
+    t.Errorf("got %q after Swap, want specific", body)
+  }
+  for _, ij := range [][2]int{{0, 2}, {-1, 0}} {
+    if err := h.Swap(ij[0], ij[1]); err == nil {
+      t.Errorf("Swap(%d, %d) succeeded", ij[0], ij[1])
+    }
+  }
+}
+
+func TestAddHeaderLimit(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddHeaderLimit("/upload", 3, write("ok"))
+  r := httptest.NewRequest("GET", "/upload", nil)
+  r.Header.Set("A", "1")
+  r.Header.Add("B", "1")
+  r.Header.Add("B", "2")
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if rec.Body.String() != "ok" {
+    t.Errorf("got %d, want a request at the limit to pass", rec.Code)
+  }
+  r.Header.Add("A", "2")
+  rec = httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+    t.Errorf("got %d, want 431 with four header values", rec.Code)
+  }
+}
+
+func TestCanonicalHost(t *testing.T) {
+  h := NewRegexpHandler()
+  h.CanonicalHost = "example.com"
+  h.Add("/a", write("a"))
+  for _, test := range []struct {
+    method, host string
+    code         int
+    location     string
+  }{
+    {"GET", "www.example.com", http.StatusMovedPermanently, "http://example.com/a?x=1"},
+    {"POST", "www.example.com:8080", http.StatusPermanentRedirect, "http://example.com/a?x=1"},
+    {"GET", "EXAMPLE.com", http.StatusOK, ""},
+    {"GET", "example.com:8080", http.StatusOK, ""},
+  } {
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, request(test.method, "/a?x=1", test.host))
+    if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+      t.Errorf("%s %s: got %d %q, want %d %q", test.method, test.host, rec.Code, rec.Header().Get("Location"), test.code, test.location)
+    }
+  }
+  r := request("GET", "/a", "www.example.com")
+  r.Header.Set("X-Forwarded-Proto", "https")
+  h.TrustForwardedProto = true
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if location := rec.Header().Get("Location"); location != "https://example.com/a" {
+    t.Errorf("got %q, want the forwarded scheme kept", location)
+  }
+}
+
+func TestAddPrefix(t *testing.T) {
+  h := NewRegexpHandler()
+  var rest string
+  called := false
+  h.AddPrefix("/static/", func(w http.ResponseWriter, r *http.Request, r2 string) {
+    rest, called = r2, true
+  })
+  for path, want := range map[string]string{
+    "/static/css/site/app.css": "css/site/app.css",
+    "/static/":                 "",
+    "/static/a%20b":            "a b",
+  } {
+    called = false
+    if serve(h, "GET", path); !called || rest != want {
+      t.Errorf("%s: got %q, called %v; want %q", path, rest, called, want)
+    }
+  }
+  called = false
+  if rec := serve(h, "GET", "/static/../secret"); rec.Code != http.StatusBadRequest || called {
+    t.Errorf("got %d, called %v; want 400 for a traversal", rec.Code, called)
+  }
+  called = false
+  if serve(h, "GET", "/static"); called {
+    t.Error("the prefix matched a path without its trailing slash")
+  }
+}
+
+func TestServerTiming(t *testing.T) {
+  h := NewRegexpHandler()
+  h.ServerTiming = true
+  h.Add("/slow", func(w http.ResponseWriter, r *http.Request, m []string) {
+    time.Sleep(20 * time.Millisecond)
+    w.Write([]byte("done"))
+  })
+  h.Add("/empty", func(w http.ResponseWriter, r *http.Request, m []string) {})
+  header := serve(h, "GET", "/slow").Header().Get("Server-Timing")
+  match := regexp.MustCompile(`^app;dur=(\d+)\.\d$`).FindStringSubmatch(header)
+  if match == nil {
+    t.Fatalf("got Server-Timing %q", header)
+  }
+  if dur, _ := strconv.Atoi(match[1]); dur < 20 || dur > 5000 {
+    t.Errorf("got a duration of %sms, want at least 20ms", match[1])
+  }
+  if header := serve(h, "GET", "/empty").Header().Get("Server-Timing"); header == "" {
+    t.Error("got no Server-Timing for a response without a body")
+  }
+}
+
+func TestDisallowedMethods(t *testing.T) {
+  h := NewRegexpHandler()
+  h.DisallowedMethods = []string{"TRACE", "connect"}
+  var observed []observation
+  h.Observe = func(pattern string, status int, duration time.Duration) {
+    observed = append(observed, observation{pattern: pattern, status: status})
+  }
+  called := false
+  h.Add(".*", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  for _, method := range []string{"TRACE", "trace", "CONNECT"} {
+    if rec := serve(h, method, "/a"); rec.Code != http.StatusNotImplemented || called {
+      t.Errorf("%s: got %d, called %v; want 501 without calling the route", method, rec.Code, called)
+    }
+  }
+  if serve(h, "GET", "/a"); !called {
+    t.Error("a GET request was refused")
+  }
+  if len(observed) != 4 || observed[0].status != http.StatusNotImplemented || observed[3].pattern != ".*" {
+    t.Errorf("got observations %v, want the refused requests observed too", observed)
+  }
+}
+
+func TestDisallowedMethodsOverridden(t *testing.T) {
+  h := NewRegexpHandler()
+  h.DisallowedMethods = []string{"DELETE"}
+  h.MethodOverride = true
+  h.AddMethod("DELETE", "/x", write("deleted"))
+  h.AddMethod("POST", "/x", write("posted"))
+  for _, test := range []struct {
+    name string
+    r    *http.Request
+    want int
+    body string
+  }{
+    {"header", httptest.NewRequest("POST", "/x", nil), http.StatusNotImplemented, ""},
+    {"form", httptest.NewRequest("POST", "/x", strings.NewReader("_method=DELETE")), http.StatusNotImplemented, ""},
+    {"sent", httptest.NewRequest("DELETE", "/x", nil), http.StatusNotImplemented, ""},
+    {"allowed", httptest.NewRequest("POST", "/x", nil), http.StatusOK, "posted"},
+  } {
+    switch test.name {
+    case "header":
+      test.r.Header.Set("X-HTTP-Method-Override", "DELETE")
+    case "form":
+      test.r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, test.r)
+    if rec.Code != test.want || test.body != "" && rec.Body.String() != test.body {
+      t.Errorf("%s: got %d %q, want %d", test.name, rec.Code, rec.Body.String(), test.want)
+    }
+  }
+  h.MethodOverride = false
+  h.MethodFunc = func(r *http.Request) string { return r.URL.Query().Get("method") }
+  if rec := serve(h, "POST", "/x?method=DELETE"); rec.Code != http.StatusNotImplemented {
+    t.Errorf("got %d for a method given by MethodFunc, want 501", rec.Code)
+  }
+}
+
+func TestAddPort(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddPort("8080", "/", write("admin"))
+  h.AddPort("443", "/", write("secure"))
+  h.Add("/", write("default"))
+  for _, test := range []struct{ host, want string }{
+    {"example.com:8080", "admin"},
+    {"example.com:80", "default"},
+    {"example.com", "default"},
+    {"example.com:443", "secure"},
+    {"[::1]:8080", "admin"},
+  } {
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, request("GET", "/", test.host))
+    if got := rec.Body.String(); got != test.want {
+      t.Errorf("%s: got %q, want %q", test.host, got, test.want)
+    }
+  }
+  r := request("GET", "/", "example.com")
+  r.TLS = &tls.ConnectionState{}
+  rec := httptest.NewRecorder()
+  if h.ServeHTTP(rec, r); rec.Body.String() != "secure" {
+    t.Errorf("got %q for https without a port, want the default port 443", rec.Body.String())
+  }
+}
+
+func TestAddPortClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddPort("443", "/", write("secure"))
+  c := h.Clone()
+  c.TrustForwardedProto = true
+  r := request("GET", "/", "example.com")
+  r.Header.Set("X-Forwarded-Proto", "https")
+  rec := httptest.NewRecorder()
+  if c.ServeHTTP(rec, r); rec.Body.String() != "secure" {
+    t.Errorf("clone: got %q, want the default https port with the clone's TrustForwardedProto", rec.Body.String())
+  }
+  rec = httptest.NewRecorder()
+  if h.ServeHTTP(rec, r); rec.Body.String() != "" {
+    t.Errorf("original: got %q, want no match on port 80", rec.Body.String())
+  }
+}
+
+func TestMethodFunc(t *testing.T) {
+  h := NewRegexpHandler()
+  h.MethodNotAllowed = true
+  h.MethodFunc = func(r *http.Request) string {
+    if method := r.URL.Query().Get("method"); method != "" {
+      return strings.ToUpper(method)
+    }
+    return r.Method
+  }
+  var seen string
+  h.AddMethod("DELETE", "/items/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    seen = r.Method
+    w.Write([]byte("delete"))
+  })
+  h.AddMethod("GET", "/items/(\\d+)", write("get"))
+  if rec := serve(h, "GET", "/items/1?method=delete"); rec.Body.String() != "delete" || seen != "GET" {
+    t.Errorf("got %q with r.Method %q, want delete with GET", rec.Body.String(), seen)
+  }
+  if rec := serve(h, "GET", "/items/1"); rec.Body.String() != "get" {
+    t.Errorf("got %q, want get", rec.Body.String())
+  }
+  rec := serve(h, "GET", "/items/1?method=put")
+  if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "DELETE, GET" {
+    t.Errorf("got %d with Allow %q, want 405 with DELETE, GET", rec.Code, rec.Header().Get("Allow"))
+  }
+  h.MethodOverride = true
+  r := httptest.NewRequest("POST", "/items/1?method=get", nil)
+  r.Header.Set("X-HTTP-Method-Override", "DELETE")
+  rec = httptest.NewRecorder()
+  if h.ServeHTTP(rec, r); rec.Body.String() != "get" {
+    t.Errorf("got %q, want MethodFunc to take precedence over MethodOverride", rec.Body.String())
+  }
+}
+
+func TestAddConsumes(t *testing.T) {
+  h := NewRegexpHandler()
+  called := false
+  h.AddConsumes("application/json", "/items", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called = true
+  })
+  for _, test := range []struct {
+    name, method, contentType, body string
+    want                            int
+    called                          bool
+  }{
+    {"matching", "POST", "application/json", "{}", http.StatusOK, true},
+    {"parameters", "PUT", "Application/JSON; charset=utf-8", "{}", http.StatusOK, true},
+    {"mismatched", "POST", "text/plain", "{}", http.StatusUnsupportedMediaType, false},
+    {"missing", "POST", "", "{}", http.StatusUnsupportedMediaType, false},
+    {"bodyless GET", "GET", "", "", http.StatusOK, true},
+    {"bodyless POST", "POST", "", "", http.StatusOK, true},
+  } {
+    called = false
+    var body io.Reader
+    if test.body != "" {
+      body = strings.NewReader(test.body)
+    }
+    r := httptest.NewRequest(test.method, "/items", body)
+    if test.contentType != "" {
+      r.Header.Set("Content-Type", test.contentType)
+    }
+    rec := httptest.NewRecorder()
+    if h.ServeHTTP(rec, r); rec.Code != test.want || called != test.called {
+      t.Errorf("%s: got %d, called %v; want %d, %v", test.name, rec.Code, called, test.want, test.called)
+    }
+  }
+}
+
+func TestReplaceRoutes(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("old a"))
+  h.Add("/b", write("old b"))
+  if err := h.ReplaceRoutes([]RouteSpec{
+    {Expression: "/a", Func: write("new a")},
+    {Expression: "/b(", Func: write("new b")},
+  }); err == nil || !strings.Contains(err.Error(), "route 1") {
+    t.Errorf("got %v, want an error naming route 1", err)
+  }
+  if body := serve(h, "GET", "/a").Body.String(); body != "old a" {
+    t.Errorf("got %q after a failed reload, want old a", body)
+  }
+  if err := h.ReplaceRoutes([]RouteSpec{
+    {Expression: "/a", Func: write("new a")},
+    {Expression: "/c", Method: "POST", Func: write("new c")},
+  }); err != nil {
+    t.Fatal(err)
+  }
+  for _, test := range []struct{ method, path, want string }{
+    {"GET", "/a", "new a"},
+    {"GET", "/b", ""},
+    {"POST", "/c", "new c"},
+    {"GET", "/c", ""},
+  } {
+    if body := serve(h, test.method, test.path).Body.String(); body != test.want {
+      t.Errorf("%s %s: got %q, want %q", test.method, test.path, body, test.want)
+    }
+  }
+}
+
+func TestReplaceRoutesConcurrent(t *testing.T) {
+  h := NewRegexpHandler()
+  tables := [][]RouteSpec{
+    {{Expression: "/a", Func: write("1")}, {Expression: "/b", Func: write("1")}},
+    {{Expression: "/a", Func: write("2")}, {Expression: "/b", Func: write("2")}},
+  }
+  if err := h.ReplaceRoutes(tables[0]); err != nil {
+    t.Fatal(err)
+  }
+  done := make(chan struct{})
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for i := 0; ; i++ {
+      select {
+      case <-done:
+        return
+      default:
+      }
+      if err := h.ReplaceRoutes(tables[i%2]); err != nil {
+        t.Error(err)
+        return
+      }
+    }
+  }()
+  for i := 0; i < 1000; i++ {
+    if body := serve(h, "GET", "/a").Body.String(); body != "1" && body != "2" {
+      t.Fatalf("got %q during a reload", body)
+    }
+  }
+  close(done)
+  wg.Wait()
+}
+
+func TestReanchor(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/users", write("users"))
+  h.AddRaw("^/raw$", write("raw"))
+  check := func(when string, want map[string]string) {
+    for path, body := range want {
+      if got := serve(h, "GET", path).Body.String(); got != body {
+        t.Errorf("%s, %s: got %q, want %q", when, path, got, body)
+      }
+    }
+  }
+  h.AnchorMode = AnchorNone
+  check("before Reanchor", map[string]string{"/users": "users", "/api/users/1": ""})
+  if err := h.Reanchor(); err != nil {
+    t.Fatal(err)
+  }
+  check("after Reanchor", map[string]string{"/users": "users", "/api/users/1": "users", "/raw": "raw", "/raw/x": ""})
+  h.AnchorMode = AnchorBoth
+  if err := h.Reanchor(); err != nil {
+    t.Fatal(err)
+  }
+  check("after anchoring again", map[string]string{"/users": "users", "/api/users/1": ""})
+}
+
+func TestAddLocalePrefix(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddLocalePrefix([]string{"en", "fr", "en-GB"}, "/(.*)", func(w http.ResponseWriter, r *http.Request, locale string, m []string) {
+    fmt.Fprintf(w, "%s %s %q", locale, r.URL.Path, m)
+  })
+  for _, test := range []struct{ name, path, want string }{
+    {"known locale", "/fr/about", `fr /about ["about"]`},
+    {"locale only", "/en/", `en / [""]`},
+    {"longer locale", "/en-GB/about", `en-GB /about ["about"]`},
+    {"no locale", "/about", ` /about ["about"]`},
+    {"unknown locale", "/de/about", ` /de/about ["de/about"]`},
+    {"locale inside a segment", "/enterprise", ` /enterprise ["enterprise"]`},
+    {"locale inside a longer segment", "/fr.json", ` /fr.json ["fr.json"]`},
+  } {
+    if body := serve(h, "GET", test.path).Body.String(); body != test.want {
+      t.Errorf("%s: got %q, want %q", test.name, body, test.want)
+    }
+  }
+}
+
+func TestAddLocalePrefixClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddLocalePrefix([]string{"en"}, "(/?\\w+)", func(w http.ResponseWriter, r *http.Request, locale string, m []string) {
+    fmt.Fprintf(w, "%s %s %q", locale, r.URL.Path, m)
+  })
+  c := h.Clone()
+  c.AnchorMode = AnchorStart
+  if err := c.Reanchor(); err != nil {
+    t.Fatal(err)
+  }
+  for _, test := range []struct{ name, path, want string }{
+    {"known locale", "/en/about/x", `en /about/x ["/about"]`},
+    {"locale inside a segment", "/enterprise/x", ` /enterprise/x ["/enterprise"]`},
+  } {
+    if body := serve(c, "GET", test.path).Body.String(); body != test.want {
+      t.Errorf("%s: got %q, want %q from the clone's reanchored expression", test.name, body, test.want)
+    }
+  }
+  if body := serve(h, "GET", "/enterprise/x").Body.String(); body != "" {
+    t.Errorf("original: got %q, want no match", body)
+  }
+}
+
+func TestStats(t *testing.T) {
+  h := NewRegexpHandler()
+  if got := h.Stats(); h.Len() != 0 || got.Routes != 0 || len(got.ByMethod) != 0 {
+    t.Errorf("got %d routes and %+v for an empty handler", h.Len(), got)
+  }
+  h.AddMethod("GET", "/a", write("a")).Name("a")
+  h.AddMethod("post", "/a", write("a"))
+  h.Add("/b", write("b")).Methods("GET", "HEAD").Name("b")
+  h.Add("/c", write("c"))
+  got := h.Stats()
+  if h.Len() != 4 || got.Routes != 4 || got.Named != 2 {
+    t.Errorf("got Len %d, %d routes and %d named; want 4, 4 and 2", h.Len(), got.Routes, got.Named)
+  }
+  if want := fmt.Sprint(map[string]int{"": 1, "GET": 2, "HEAD": 1, "POST": 1}); fmt.Sprint(got.ByMethod) != want {
+    t.Errorf("got counts by method %v, want %s", got.ByMethod, want)
+  }
+}
+
+func TestSkipCancelled(t *testing.T) {
+  h := NewRegexpHandler()
+  var observed []observation
+  h.Observe = func(pattern string, status int, duration time.Duration) {
+    observed = append(observed, observation{pattern: pattern, status: status})
+  }
+  called := 0
+  h.Add("/a", func(w http.ResponseWriter, r *http.Request, m []string) {
+    called++
+  })
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  cancelled := httptest.NewRequest("GET", "/a", nil).WithContext(ctx)
+  h.ServeHTTP(httptest.NewRecorder(), cancelled)
+  if called != 1 {
+    t.Fatalf("got %d calls without SkipCancelled, want 1", called)
+  }
+  h.SkipCancelled = true
+  rec := httptest.NewRecorder()
+  if h.ServeHTTP(rec, cancelled); called != 1 || rec.Body.Len() != 0 {
+    t.Errorf("got %d calls and %q, want the cancelled request skipped", called, rec.Body.String())
+  }
+  if serve(h, "GET", "/a"); called != 2 {
+    t.Error("a request that wasn't cancelled was skipped")
+  }
+  if len(observed) != 3 || observed[1].status != 499 || observed[2].status != http.StatusOK {
+    t.Errorf("got observations %v, want the skipped request observed with 499", observed)
+  }
+}
+
+func TestAddEscaped(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddEscaped("/files/(.*)/(\\w+)", func(w http.ResponseWriter, r *http.Request, m, raw []string) {
+    fmt.Fprintf(w, "%q %q", m, raw)
+  })
+  h.AddEscaped("/pairs/(.+)/(.+)", func(w http.ResponseWriter, r *http.Request, m, raw []string) {
+    fmt.Fprintf(w, "%q %q", m, raw)
+  })
+  for _, test := range []struct{ path, want string }{
+    {"/files/a%2Fb/c", `["a/b" "c"] ["a%2Fb" "c"]`},
+    {"/files/a%20b/c", `["a b" "c"] ["a%20b" "c"]`},
+    {"/files/a/b/c", `["a/b" "c"] ["a/b" "c"]`},
+    {"/pairs/a%2Fb", `["a" "b"] ["" ""]`},
+  } {
+    if body := serve(h, "GET", test.path).Body.String(); body != test.want {
+      t.Errorf("%s: got %s, want %s", test.path, body, test.want)
+    }
+  }
+}
+
+func TestAddEscapedClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddEscaped("/files/([^/]+)", func(w http.ResponseWriter, r *http.Request, m, raw []string) {
+    fmt.Fprintf(w, "%q %q", m, raw)
+  })
+  c := h.Clone()
+  c.AnchorMode = AnchorStart
+  if err := c.Reanchor(); err != nil {
+    t.Fatal(err)
+  }
+  want := `["a b"] ["a%20b"]`
+  if body := serve(c, "GET", "/files/a%20b/c").Body.String(); body != want {
+    t.Errorf("got %s, want %s from the clone's reanchored expression", body, want)
+  }
+}
+
+func TestAddRoot(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AnchorMode = AnchorNone
+  h.AddRoot(write("root"))
+  h.Add("/users", write("users"))
+  stripped := httptest.NewRequest("GET", "/", nil)
+  stripped.URL.Path = ""
+  for _, clean := range []bool{false, true} {
+    h.CleanPath = clean
+    rec := httptest.NewRecorder()
+    if h.ServeHTTP(rec, stripped); rec.Body.String() != "root" {
+      t.Errorf("CleanPath %v, empty path: got %q, want root", clean, rec.Body.String())
+    }
+    for path, want := range map[string]string{"/": "root", "/users": "users", "/other": ""} {
+      if body := serve(h, "GET", path).Body.String(); body != want {
+        t.Errorf("CleanPath %v, %s: got %q, want %q", clean, path, body, want)
+      }
+    }
+  }
+  if body := serve(h, "GET", "//").Body.String(); body != "root" {
+    t.Errorf("got %q for a cleaned //, want root", body)
+  }
+}
+
+func TestErrPassThrough(t *testing.T) {
+  h := NewRegexpHandler()
+  h.WriteNotFound = true
+  h.AddErr("/files/(.*)", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    if m[0] != "cached" {
+      return ErrPassThrough
+    }
+    w.Write([]byte("cache"))
+    return nil
+  })
+  h.AddErr("/files/(.*)", func(w http.ResponseWriter, r *http.Request, m []string) error {
+    if m[0] == "written" {
+      w.Write([]byte("partial "))
+      return ErrPassThrough
+    }
+    if m[0] == "missing" {
+      return fmt.Errorf("wrapped: %w", ErrPassThrough)
+    }
+    return ErrPassThrough
+  })
+  h.Add("/files/(\\w+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Write([]byte(fmt.Sprint("disk ", SubmatchesFromContext(r))))
+  })
+  for _, test := range []struct {
+    path, want string
+    status     int
+  }{
+    {"/files/cached", "cache", http.StatusOK},
+    {"/files/a", "disk [a]", http.StatusOK},
+    {"/files/written", "partial ", http.StatusOK},
+    {"/files/a/b", "404 page not found\n", http.StatusNotFound},
+    {"/files/missing", "disk [missing]", http.StatusOK},
+  } {
+    rec := serve(h, "GET", test.path)
+    if rec.Code != test.status || rec.Body.String() != test.want {
+      t.Errorf("%s: got %d %q, want %d %q", test.path, rec.Code, rec.Body.String(), test.status, test.want)
+    }
+  }
+}
+
+func TestAddChecked(t *testing.T) {
+  h := NewRegexpHandler()
+  rt, err := h.AddChecked("/users/(\\d+)", []string{"/users/1", "/users/42"}, []string{"/users/", "/users/x", "/users/1/posts"}, write("user"))
+  if err != nil || rt == nil {
+    t.Fatalf("got %v, %v for a correct set of checks", rt, err)
+  }
+  if body := serve(h, "GET", "/users/42").Body.String(); body != "user" {
+    t.Errorf("got %q, want the checked route registered", body)
+  }
+  for _, test := range []struct {
+    expression         string
+    mustMatch, mustNot []string
+    want               string
+  }{
+    {"/posts/(\\d+)", []string{"/posts/1", "/posts/new"}, nil, `handler: expression "/posts/(\\d+)" does not match "/posts/new"`},
+    {"/posts/(.*)", nil, []string{"/posts/"}, `handler: expression "/posts/(.*)" matches "/posts/"`},
+    {"/posts/(", nil, nil, "error parsing regexp"},
+  } {
+    if rt, err := h.AddChecked(test.expression, test.mustMatch, test.mustNot, write("post")); rt != nil || err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: got %v, %v; want an error containing %q", test.expression, rt, err, test.want)
+    }
+  }
+  if h.Len() != 1 {
+    t.Errorf("got %d routes, want failed checks to register none", h.Len())
+  }
+}
+
+func TestAddIf(t *testing.T) {
+  h := NewRegexpHandler()
+  var enabled atomic.Bool
+  h.AddIf(enabled.Load, "/search", write("new search"))
+  h.Add("/search", write("old search"))
+  h.AddIf(enabled.Load, "/beta", write("beta"))
+  for _, on := range []bool{false, true, false} {
+    enabled.Store(on)
+    want, beta := "old search", ""
+    if on {
+      want, beta = "new search", "beta"
+    }
+    if body := serve(h, "GET", "/search").Body.String(); body != want {
+      t.Errorf("enabled %v: got %q, want %q", on, body, want)
+    }
+    if body := serve(h, "GET", "/beta").Body.String(); body != beta {
+      t.Errorf("enabled %v: got %q for /beta, want %q", on, body, beta)
+    }
+  }
+}
+
+type spanKey struct{}
+
+func TestStartSpan(t *testing.T) {
+  h := NewRegexpHandler()
+  h.WriteNotFound = true
+  var events []string
+  h.StartSpan = func(r *http.Request, pattern string) (context.Context, func(int)) {
+    events = append(events, "start "+pattern)
+    return context.WithValue(r.Context(), spanKey{}, "span"), func(status int) {
+      events = append(events, fmt.Sprint("end ", status))
+    }
+  }
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      events = append(events, fmt.Sprint("middleware ", r.Context().Value(spanKey{})))
+      next.ServeHTTP(w, r)
+    })
+  })
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    events = append(events, fmt.Sprint("route ", r.Context().Value(spanKey{})))
+    w.WriteHeader(http.StatusCreated)
+  })
+  serve(h, "GET", "/users/1")
+  serve(h, "GET", "/missing")
+  want := `["start /users/(\\d+)" "middleware span" "route span" "end 201" "start " "middleware span" "end 404"]`
+  if got := fmt.Sprintf("%q", events); got != want {
+    t.Errorf("got %s, want %s", got, want)
+  }
+}
+
+func TestHostCaseInsensitive(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddHost("api\\.example\\.com", "/", write("sensitive"))
+  h.HostCaseInsensitive = true
+  h.AddHost("api\\.example\\.com", "/", write("insensitive"))
+  h.AddHost("xn--bcher-kva\\.example", "/", write("idn"))
+  for _, test := range []struct{ host, want string }{
+    {"api.example.com", "sensitive"},
+    {"API.Example.COM:8080", "insensitive"},
+    {"xn--BCHER-kva.example", "idn"},
+    {"bücher.example", ""},
+  } {
+    rec := httptest.NewRecorder()
+    if h.ServeHTTP(rec, request("GET", "/", test.host)); rec.Body.String() != test.want {
+      t.Errorf("%s: got %q, want %q", test.host, rec.Body.String(), test.want)
+    }
+  }
+}
+
+func TestUseMatched(t *testing.T) {
+  h := NewRegexpHandler()
+  h.WriteNotFound = true
+  h.MethodNotAllowed = true
+  var log []string
+  h.Use(record(&log, "always"))
+  h.UseMatched(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      pattern, _ := MatchedPattern(r)
+      log = append(log, "matched "+pattern)
+      next.ServeHTTP(w, r)
+    })
+  })
+  h.UseMatched(record(&log, "matched second"))
+  h.AddMethod("GET", "/users/(\\d+)", write("user")).Use(record(&log, "route"))
+  for _, test := range []struct {
+    method, path string
+    want         string
+  }{
+    {"GET", "/users/1", `["always[1]" "matched /users/(\\d+)" "matched second[1]" "route[1]"]`},
+    {"GET", "/missing", `["always[]"]`},
+    {"POST", "/users/1", `["always[]"]`},
+  } {
+    log = nil
+    serve(h, test.method, test.path)
+    if got := fmt.Sprintf("%q", log); got != test.want {
+      t.Errorf("%s %s: got %s, want %s", test.method, test.path, got, test.want)
+    }
+  }
+}
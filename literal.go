@@ -0,0 +1,80 @@
+package handler
+
+import (
+  "io"
+  "net/http"
+  "regexp"
+  "strings"
+)
+
+// AddLiteral is like Add, but the route matches requests whose path equals
+// path exactly, without running a regular expression for it unless an
+// earlier route might match the path too. The order of precedence is the
+// same as for other routes. CaseInsensitive and AnchorMode don't apply, and
+// the function receives an empty slice of submatches. The route's expression,
+// as reported by Routes, is path quoted with regexp.QuoteMeta.
+func (h *RegexpHandler) AddLiteral(path string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  expression := regexp.QuoteMeta(path)
+  return h.addRoute(&Route{
+    expression: expression,
+    re:         regexp.MustCompile("^" + expression + "$"),
+    verbatim:   true,
+    literal:    true,
+    f:          function,
+  })
+}
+
+// Health registers a literal route at path answering health checks. If check
+// is nil or returns nil, the request is answered with 200 OK and the body
+// "ok"; otherwise with 503 Service Unavailable and the error's text. check is
+// called for every request, so that it reflects the current state.
+func (h *RegexpHandler) Health(path string, check func() error) *Route {
+  return h.AddLiteral(path, func(w http.ResponseWriter, r *http.Request, m []string) {
+    if check != nil {
+      if err := check(); err != nil {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+      }
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    io.WriteString(w, "ok")
+  })
+}
+
+// exactIndex maps the paths of the literal routes among routes to the index
+// of the first one with each path, or returns nil if there are none.
+func exactIndex(routes []*Route) map[string]int {
+  var exact map[string]int
+  for i, rt := range routes {
+    if !rt.literal {
+      continue
+    }
+    if exact == nil {
+      exact = make(map[string]int)
+    }
+    if _, ok := exact[rt.literalPrefix]; !ok {
+      exact[rt.literalPrefix] = i
+    }
+  }
+  return exact
+}
+
+// findLiteral returns the literal route that serves a request with the given
+// path and method, or nil if the request must be matched against the routes
+// one by one: because no literal route has the path, an earlier route's
+// expression matches the path too, or the literal route rejects the request.
+func (h *RegexpHandler) findLiteral(routes []*Route, r *http.Request, path, method string) *Route {
+  i, ok := h.exact[path]
+  if !ok || i >= len(routes) {
+    return nil
+  }
+  for _, rt := range routes[:i] {
+    if strings.HasPrefix(path, rt.literalPrefix) && rt.re.MatchString(path) {
+      return nil
+    }
+  }
+  if rt := routes[i]; rt.matchesRequest(r) && rt.matchesMethod(method) {
+    return rt
+  }
+  return nil
+}
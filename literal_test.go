@@ -0,0 +1,98 @@
+package handler
+
+import (
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func TestAddLiteral(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []string
+  h.AddLiteral("/a.b", func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = m
+    w.Write([]byte("literal"))
+  })
+  if body := serve(h, "GET", "/a.b").Body.String(); body != "literal" || got == nil || len(got) != 0 {
+    t.Errorf("got %q with submatches %#v, want the literal route with none", body, got)
+  }
+  if body := serve(h, "GET", "/axb").Body.String(); body != "" {
+    t.Errorf("got %q, want the dot to be matched literally", body)
+  }
+}
+
+func TestAddLiteralPrecedence(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/users/(\\d+)", write("regexp before"))
+  h.AddLiteral("/users/42", write("literal"))
+  h.AddLiteral("/users/new", write("literal new"))
+  h.Add("/users/new", write("regexp after"))
+  h.AddMethod("POST", "/users/post", write("post only"))
+  h.AddLiteral("/users/post", write("literal post"))
+  for _, test := range []struct {
+    method, path, want string
+  }{
+    // An earlier regexp route still wins over a literal one.
+    {"GET", "/users/42", "regexp before"},
+    // A literal route wins over a later regexp route.
+    {"GET", "/users/new", "literal new"},
+    // An earlier route restricted to another method doesn't shadow it.
+    {"GET", "/users/post", "literal post"},
+    {"POST", "/users/post", "post only"},
+  } {
+    if body := serve(h, test.method, test.path).Body.String(); body != test.want {
+      t.Errorf("%s %s: got %q, want %q", test.method, test.path, body, test.want)
+    }
+  }
+}
+
+func TestHealth(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Health("/healthz", nil)
+  var err error
+  calls := 0
+  h.Health("/ready", func() error {
+    calls++
+    return err
+  })
+  for _, path := range []string{"/healthz", "/ready"} {
+    if rec := serve(h, "GET", path); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+      t.Errorf("%s: got %d %q, want 200 ok", path, rec.Code, rec.Body.String())
+    }
+  }
+  err = errors.New("database down")
+  rec := serve(h, "GET", "/ready")
+  if rec.Code != http.StatusServiceUnavailable || strings.TrimSpace(rec.Body.String()) != "database down" {
+    t.Errorf("got %d %q, want 503 with the check's error", rec.Code, rec.Body.String())
+  }
+  if calls != 2 {
+    t.Errorf("got %d calls of the check, want one per request", calls)
+  }
+}
+
+// benchmarkLiteral measures dispatching a request for the last of 50 routes,
+// which are either literal or equivalent regexp routes.
+func benchmarkLiteral(b *testing.B, literal bool) {
+  h := NewRegexpHandler()
+  for i := 0; i < 50; i++ {
+    path := fmt.Sprintf("/pages/%d/about", i)
+    if literal {
+      h.AddLiteral(path, write(""))
+    } else {
+      h.Add(path, write(""))
+    }
+  }
+  r := httptest.NewRequest("GET", "/pages/49/about", nil)
+  w := httptest.NewRecorder()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    h.ServeHTTP(w, r)
+  }
+}
+
+func BenchmarkLiteralRoutes(b *testing.B) { benchmarkLiteral(b, true) }
+func BenchmarkRegexpRoutes(b *testing.B)  { benchmarkLiteral(b, false) }
@@ -0,0 +1,93 @@
+package handler
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// LogEntry describes a request served by a handler, see Logger.
+type LogEntry struct {
+  Method string
+  Path   string
+  // Pattern is the expression of the route that matched, or "" if none did.
+  Pattern  string
+  Status   int
+  Bytes    int64
+  Duration time.Duration
+}
+
+// String formats the entry as a logfmt line without a trailing newline.
+func (e LogEntry) String() string {
+  return fmt.Sprintf("method=%s path=%q pattern=%q status=%d bytes=%d duration=%s", e.Method, e.Path, e.Pattern, e.Status, e.Bytes, e.Duration)
+}
+
+// Logger returns a middleware, for use with Use, that writes a line to out for
+// each request once it has been served. The line is formatted by format, or
+// by LogEntry.String if format is nil, and followed by a newline. Only a
+// sample of the requests to routes added through AddSampled is logged.
+func Logger(out io.Writer, format func(LogEntry) string) func(http.Handler) http.Handler {
+  if format == nil {
+    format = LogEntry.String
+  }
+  var mu sync.Mutex
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      start := time.Now()
+      rw := &responseWriter{ResponseWriter: w}
+      next.ServeHTTP(rw, r)
+      if m := matchFromContext(r); m.route != nil && !m.route.sampler.log() {
+        return
+      }
+      pattern, _ := MatchedPattern(r)
+      line := format(LogEntry{
+        Method:   r.Method,
+        Path:     r.URL.Path,
+        Pattern:  pattern,
+        Status:   rw.Status(),
+        Bytes:    rw.bytes,
+        Duration: time.Since(start),
+      })
+      mu.Lock()
+      io.WriteString(out, line+"\n")
+      mu.Unlock()
+    })
+  }
+}
+
+// AddSampled is like Add, but Logger only logs the given fraction of the
+// requests the route serves, e.g. one in ten for a rate of 0.1. Every request
+// is still served. Sampling is deterministic: the route counts its requests
+// and logs the n'th if floor(n*rate) exceeds floor((n-1)*rate), so that
+// exactly the fraction is logged over any sequence of requests, up to
+// rounding. AddSampled panics if rate is not between 0 and 1.
+func (h *RegexpHandler) AddSampled(expression string, rate float64, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  if !(rate >= 0 && rate <= 1) {
+    panic(fmt.Errorf("handler: invalid sampling rate %v", rate))
+  }
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.sampler = &sampler{rate: rate}
+  return h.addRoute(rt)
+}
+
+// sampler selects the requests of a route that are logged, see AddSampled.
+type sampler struct {
+  rate float64
+  n    atomic.Uint64
+}
+
+// log reports whether the next request should be logged. A nil sampler logs
+// every request.
+func (s *sampler) log() bool {
+  if s == nil {
+    return true
+  }
+  n := s.n.Add(1)
+  return uint64(float64(n)*s.rate) != uint64(float64(n-1)*s.rate)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+  "bytes"
+  "fmt"
+  "math"
+  "math/rand"
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestLogger(t *testing.T) {
+  var out bytes.Buffer
+  h := NewRegexpHandler()
+  h.Use(Logger(&out, nil))
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte("hello"))
+  })
+  serve(h, "POST", "/users/42")
+  serve(h, "GET", "/missing")
+  lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+  if len(lines) != 2 {
+    t.Fatalf("got %d lines, want 2: %q", len(lines), out.String())
+  }
+  want := `method=POST path="/users/42" pattern="/users/(\\d+)" status=201 bytes=5 duration=`
+  if !strings.HasPrefix(lines[0], want) {
+    t.Errorf("got %q, want it to start with %q", lines[0], want)
+  }
+  want = `method=GET path="/missing" pattern="" status=200 bytes=0 duration=`
+  if !strings.HasPrefix(lines[1], want) {
+    t.Errorf("got %q, want it to start with %q", lines[1], want)
+  }
+}
+
+func TestLoggerFormat(t *testing.T) {
+  var out bytes.Buffer
+  h := NewRegexpHandler()
+  h.Use(Logger(&out, func(e LogEntry) string {
+    return fmt.Sprintf(`{"method":%q,"pattern":%q,"status":%d}`, e.Method, e.Pattern, e.Status)
+  }))
+  h.Add("/a", write("a"))
+  serve(h, "GET", "/a")
+  if got := out.String(); got != `{"method":"GET","pattern":"/a","status":200}`+"\n" {
+    t.Errorf("got %q", got)
+  }
+}
+
+func TestAddSampled(t *testing.T) {
+  var out bytes.Buffer
+  h := NewRegexpHandler()
+  h.Use(Logger(&out, func(e LogEntry) string { return e.Pattern }))
+  served := map[string]int{}
+  for _, test := range []struct {
+    expression string
+    rate       float64
+  }{{"/tenth", 0.1}, {"/third", 1.0 / 3}, {"/none", 0}} {
+    expression := test.expression
+    h.AddSampled(expression, test.rate, func(w http.ResponseWriter, r *http.Request, m []string) {
+      served[expression]++
+    })
+  }
+  h.Add("/all", write("all"))
+  rng := rand.New(rand.NewSource(1))
+  paths := []string{"/tenth", "/third", "/none", "/all"}
+  requests := map[string]int{}
+  for i := 0; i < 3000; i++ {
+    path := paths[rng.Intn(len(paths))]
+    requests[path]++
+    serve(h, "GET", path)
+  }
+  logged := map[string]int{}
+  for _, line := range strings.Fields(out.String()) {
+    logged[line]++
+  }
+  for path, rate := range map[string]float64{"/tenth": 0.1, "/third": 1.0 / 3, "/none": 0, "/all": 1} {
+    if path != "/all" && served[path] != requests[path] {
+      t.Errorf("%s: served %d of %d requests, want all", path, served[path], requests[path])
+    }
+    if want := rate * float64(requests[path]); math.Abs(float64(logged[path])-want) > 1 {
+      t.Errorf("%s: logged %d of %d requests, want about %.0f", path, logged[path], requests[path], want)
+    }
+  }
+}
+
+func TestAddSampledInvalidRate(t *testing.T) {
+  for _, rate := range []float64{-0.1, 1.5, math.NaN()} {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Errorf("rate %v: AddSampled didn't panic", rate)
+        }
+      }()
+      NewRegexpHandler().AddSampled("/a", rate, write("a"))
+    }()
+  }
+}
@@ -0,0 +1,34 @@
+package handler
+
+// Matcher selects the route that serves a request, given the string routes
+// match against (see PathFunc) and the request's method. It returns the index
+// of the route in order of precedence, as listed by Routes, and the
+// submatches to pass to its function.
+type Matcher interface {
+  Match(path, method string) (index int, submatches []string, ok bool)
+}
+
+// LinearMatcher returns a Matcher that tries the expressions and methods of
+// the handler's current routes in order of precedence, the way ServeHTTP
+// does by default. It doesn't see routes registered later, nor requirements
+// other than the path and method, such as hosts. It's meant as a fallback
+// for custom matchers.
+func (h *RegexpHandler) LinearMatcher() Matcher {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  return linearMatcher(h.routes)
+}
+
+type linearMatcher []*Route
+
+func (routes linearMatcher) Match(path, method string) (int, []string, bool) {
+  for i, rt := range routes {
+    if !rt.matchesMethod(method) {
+      continue
+    }
+    if submatches, ok := rt.submatches(path); ok {
+      return i, submatches, true
+    }
+  }
+  return 0, nil, false
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+)
+
+// stubMatcher selects the route at a fixed index for every request.
+type stubMatcher struct {
+  index int
+  calls []string
+}
+
+func (m *stubMatcher) Match(path, method string) (int, []string, bool) {
+  m.calls = append(m.calls, method+" "+path)
+  return m.index, []string{"stub"}, m.index >= 0
+}
+
+func TestMatcher(t *testing.T) {
+  h := NewRegexpHandler()
+  var got []string
+  h.Add("/a", write("a"))
+  h.Add("/b", func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = m
+  })
+  stub := &stubMatcher{index: 1}
+  h.Matcher = stub
+  serve(h, "POST", "/a")
+  if fmt.Sprint(got) != "[stub]" || fmt.Sprint(stub.calls) != "[POST /a]" {
+    t.Errorf("got submatches %v and calls %v, want ServeHTTP to use the matcher", got, stub.calls)
+  }
+  stub.index = -1
+  if body := serve(h, "GET", "/a").Body.String(); body != "" {
+    t.Errorf("got %q, want no route when the matcher finds none", body)
+  }
+}
+
+func TestLinearMatcher(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddMethod("POST", "/users/(\\d+)", write("post"))
+  h.Add("/users/(\\d+)", write("any"))
+  m := h.LinearMatcher()
+  for _, test := range []struct {
+    method, path string
+    index        int
+    ok           bool
+  }{
+    {"POST", "/users/1", 0, true},
+    {"GET", "/users/1", 1, true},
+    {"GET", "/users/x", 0, false},
+  } {
+    if i, _, ok := m.Match(test.path, test.method); i != test.index || ok != test.ok {
+      t.Errorf("%s %s: got %d %v, want %d %v", test.method, test.path, i, ok, test.index, test.ok)
+    }
+  }
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+  "net/http"
+  "strings"
+)
+
+// prefixIndex groups routes by the first segment of their literal prefix, e.g.
+// "/api/" for "/api/v1/users/(\\d+)", so that a request is only matched
+// against the routes whose literal prefix is compatible with its path.
+type prefixIndex struct {
+  // segments maps first segments to the indexes of the routes whose literal
+  // prefix starts with them, in order of precedence.
+  segments map[string][]int
+  // rest holds the indexes of the routes whose literal prefix doesn't
+  // contain a whole first segment, in order of precedence. They are tried
+  // for every request.
+  rest []int
+}
+
+// newPrefixIndex indexes routes, or returns nil if no route has a literal
+// prefix containing a whole first segment, since the index would then not
+// skip any route.
+func newPrefixIndex(routes []*Route) *prefixIndex {
+  p := &prefixIndex{segments: make(map[string][]int)}
+  for i, rt := range routes {
+    if segment := firstSegment(rt.literalPrefix); segment != "" {
+      p.segments[segment] = append(p.segments[segment], i)
+    } else {
+      p.rest = append(p.rest, i)
+    }
+  }
+  if len(p.segments) == 0 {
+    return nil
+  }
+  return p
+}
+
+// firstSegment returns s up to and including the first slash after its first
+// byte, or "" if there is none. A path starts with a route's literal prefix
+// only if both have the same first segment, unless the prefix has none.
+func firstSegment(s string) string {
+  if len(s) < 2 {
+    return ""
+  }
+  i := strings.IndexByte(s[1:], '/')
+  if i < 0 {
+    return ""
+  }
+  return s[:i+2]
+}
+
+// scan is like RegexpHandler.scan, but only tries the routes the index
+// doesn't rule out for path, in order of precedence.
+func (p *prefixIndex) scan(h *RegexpHandler, m *match, routes []*Route, r *http.Request, path, method string) {
+  indexed, rest := p.segments[firstSegment(path)], p.rest
+  for len(indexed) > 0 || len(rest) > 0 {
+    var i int
+    if len(rest) == 0 || len(indexed) > 0 && indexed[0] < rest[0] {
+      i, indexed = indexed[0], indexed[1:]
+    } else {
+      i, rest = rest[0], rest[1:]
+    }
+    if i < len(routes) && h.try(m, routes, i, r, path, method) {
+      return
+    }
+  }
+}
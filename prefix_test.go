@@ -0,0 +1,117 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+// prefixed registers n routes under "/api/vN/" prefixes, interleaved with
+// routes without a usable literal prefix, each writing its index.
+func prefixed(h *RegexpHandler, n int) {
+  for i := 0; i < n; i++ {
+    var expression string
+    switch i % 10 {
+    case 3:
+      expression = "/(api|files)/v\\d+/x"
+    case 7:
+      expression = "(?i)/api/v1/users/admin"
+    default:
+      expression = fmt.Sprintf("/api/v%d/users/(\\d+)", i%4)
+      if i%2 == 0 {
+        expression = fmt.Sprintf("/%s/v%d/items/(\\w+)", []string{"api", "static", "files"}[i%3], i)
+      }
+    }
+    i := i
+    h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+      fmt.Fprint(w, i, m)
+    })
+  }
+}
+
+func TestFirstSegment(t *testing.T) {
+  for s, want := range map[string]string{
+    "":          "",
+    "/":         "",
+    "/api":      "",
+    "/api/":     "/api/",
+    "/api/v1/x": "/api/",
+    "//a":       "//",
+    "api/x/y":   "api/",
+  } {
+    if got := firstSegment(s); got != want {
+      t.Errorf("firstSegment(%q) = %q, want %q", s, got, want)
+    }
+  }
+}
+
+func TestPrefixIndexMatchesNaiveScan(t *testing.T) {
+  h := NewRegexpHandler()
+  prefixed(h, 100)
+  if h.prefixes == nil {
+    t.Fatal("no prefix index was built")
+  }
+  var paths []string
+  for _, first := range []string{"api", "API", "static", "files", "other"} {
+    for v := 0; v < 100; v += 7 {
+      for _, rest := range []string{"users/1", "users/admin", "items/a", "x", ""} {
+        paths = append(paths, fmt.Sprintf("/%s/v%d/%s", first, v, rest))
+      }
+    }
+  }
+  paths = append(paths, "", "/", "/api", "/api/", "//api/v1/users/1")
+  for _, mode := range []MatchMode{MatchFirst, MatchSpecific} {
+    h.MatchMode = mode
+    for _, path := range paths {
+      r := httptest.NewRequest("GET", "/", nil)
+      r.URL.Path = path
+      got := h.find(h.routes, nil, r, "GET")
+      want := &match{}
+      h.scan(want, h.routes, r, path, "GET")
+      if got.route != want.route || fmt.Sprint(got.submatches) != fmt.Sprint(want.submatches) {
+        t.Errorf("mode %d, %q: got %v %q, want %v %q", mode, path, got.route, got.submatches, want.route, want.submatches)
+      }
+    }
+  }
+}
+
+func TestPrefixIndexRebuilt(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/api/v1/users", write("users"))
+  h.Add("/(.*)", write("any"))
+  if body := serve(h, "GET", "/api/v1/users").Body.String(); body != "users" {
+    t.Errorf("got %q, want users", body)
+  }
+  h.Remove("/api/v1/users")
+  h.Add("/api/v1/users", write("shadowed"))
+  if body := serve(h, "GET", "/api/v1/users").Body.String(); body != "any" {
+    t.Errorf("got %q after reordering, want any", body)
+  }
+}
+
+// benchmarkPrefixed measures dispatching a request matched by one of the last
+// of 100 prefixed routes: with the prefix index, with only the literal prefix
+// check of each route, or with every route's expression run in turn.
+func benchmarkPrefixed(b *testing.B, mode string) {
+  h := NewRegexpHandler()
+  prefixed(h, 100)
+  switch mode {
+  case "prefilter":
+    h.prefixes = nil
+  case "naive":
+    h.Matcher = h.LinearMatcher()
+  }
+  r := httptest.NewRequest("GET", "/static/v98/items/x", nil)
+  w := httptest.NewRecorder()
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    w.Body.Reset()
+    h.ServeHTTP(w, r)
+  }
+}
+
+func BenchmarkPrefixIndex100(b *testing.B)     { benchmarkPrefixed(b, "index") }
+func BenchmarkPrefixPrefilter100(b *testing.B) { benchmarkPrefixed(b, "prefilter") }
+func BenchmarkNaiveScan100(b *testing.B)       { benchmarkPrefixed(b, "naive") }
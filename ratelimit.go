@@ -0,0 +1,106 @@
+package handler
+
+import (
+  "math"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// maxBuckets is the maximum number of per-client buckets a route keeps, see
+// RateLimitByClient. Once it is reached, the buckets that have refilled
+// completely are evicted, and if there are none, the least recently used one
+// is, so that clients sending from many addresses can't grow the map without
+// bound. A client whose bucket was evicted starts over with a full one.
+const maxBuckets = 1024
+
+// AddRateLimit is like Add, but the function is called for at most rps
+// requests per second on average, with bursts of up to burst requests.
+// Requests beyond that are answered with 429 Too Many Requests and a
+// Retry-After header. The limit applies to all requests of the route
+// together, or to each client separately if RateLimitByClient is set.
+func (h *RegexpHandler) AddRateLimit(expression string, rps float64, burst int, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  l := &rateLimiter{rps: rps, burst: float64(burst), buckets: make(map[string]*bucket)}
+  return h.Add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    var key string
+    // The setting is looked up per request, as a clone has its own.
+    if matchFromContext(r).route.h.RateLimitByClient {
+      key = stripPort(r.RemoteAddr)
+    }
+    if wait, ok := l.take(key, time.Now()); !ok {
+      w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+      http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+      return
+    }
+    function(w, r, m)
+  })
+}
+
+// rateLimiter holds the token buckets of a route added through AddRateLimit.
+type rateLimiter struct {
+  rps     float64
+  burst   float64
+  mu      sync.Mutex
+  buckets map[string]*bucket
+}
+
+type bucket struct {
+  tokens float64
+  last   time.Time
+}
+
+// take takes a token from the bucket for key. If the bucket is empty, it
+// reports false and how long it takes until a token is available.
+func (l *rateLimiter) take(key string, now time.Time) (time.Duration, bool) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  b := l.buckets[key]
+  if b == nil {
+    if len(l.buckets) >= maxBuckets {
+      l.evict(now)
+    }
+    b = &bucket{tokens: l.burst, last: now}
+    l.buckets[key] = b
+  }
+  l.refill(b, now)
+  if b.tokens < 1 {
+    if l.rps <= 0 {
+      return time.Hour, false
+    }
+    return time.Duration((1 - b.tokens) / l.rps * float64(time.Second)), false
+  }
+  b.tokens--
+  return 0, true
+}
+
+// refill adds the tokens accrued since the bucket was last used.
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+  b.tokens = l.tokens(b, now)
+  b.last = now
+}
+
+// tokens returns the tokens the bucket holds at now, without using it.
+func (l *rateLimiter) tokens(b *bucket, now time.Time) float64 {
+  return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+}
+
+// evict removes the buckets that have refilled completely, since they behave
+// like new ones, or the least recently used bucket if none has. It leaves the
+// time the remaining buckets were last used alone, so that later evictions
+// still find the least recently used one.
+func (l *rateLimiter) evict(now time.Time) {
+  var oldest string
+  var oldestLast time.Time
+  for key, b := range l.buckets {
+    if oldestLast.IsZero() || b.last.Before(oldestLast) {
+      oldest, oldestLast = key, b.last
+    }
+    if l.tokens(b, now) >= l.burst {
+      delete(l.buckets, key)
+    }
+  }
+  if len(l.buckets) >= maxBuckets {
+    delete(l.buckets, oldest)
+  }
+}
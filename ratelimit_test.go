@@ -0,0 +1,98 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestAddRateLimit(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddRateLimit("/api", 20, 2, write("ok"))
+  for i := 0; i < 2; i++ {
+    if rec := serve(h, "GET", "/api"); rec.Code != http.StatusOK {
+      t.Fatalf("request %d: got %d within the burst", i, rec.Code)
+    }
+  }
+  rec := serve(h, "GET", "/api")
+  if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+    t.Fatalf("got %d with Retry-After %q, want 429 once the bucket is empty", rec.Code, rec.Header().Get("Retry-After"))
+  }
+  // At 20 requests per second, a token is back after 50ms.
+  time.Sleep(60 * time.Millisecond)
+  if rec := serve(h, "GET", "/api"); rec.Code != http.StatusOK {
+    t.Errorf("got %d after the refill interval, want 200", rec.Code)
+  }
+}
+
+func TestRateLimitByClient(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RateLimitByClient = true
+  h.AddRateLimit("/api", 0.001, 1, write("ok"))
+  from := func(addr string) int {
+    r := httptest.NewRequest("GET", "/api", nil)
+    r.RemoteAddr = addr
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, r)
+    return rec.Code
+  }
+  if from("10.0.0.1:1000") != http.StatusOK || from("10.0.0.1:2000") != http.StatusTooManyRequests {
+    t.Error("the port wasn't ignored when telling clients apart")
+  }
+  if from("10.0.0.2:1000") != http.StatusOK {
+    t.Error("another client was limited")
+  }
+}
+
+func TestRateLimitByClientClone(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddRateLimit("/api", 0.001, 1, write("ok"))
+  c := h.Clone()
+  c.RateLimitByClient = true
+  from := func(addr string) int {
+    r := httptest.NewRequest("GET", "/api", nil)
+    r.RemoteAddr = addr
+    rec := httptest.NewRecorder()
+    c.ServeHTTP(rec, r)
+    return rec.Code
+  }
+  if from("10.0.0.1:1000") != http.StatusOK || from("10.0.0.2:1000") != http.StatusOK {
+    t.Error("clients were limited together despite the clone's RateLimitByClient")
+  }
+}
+
+func TestRateLimiterBucketCap(t *testing.T) {
+  l := &rateLimiter{rps: 0.001, burst: 1, buckets: make(map[string]*bucket)}
+  now := time.Now()
+  for i := 0; i < 3*maxBuckets; i++ {
+    l.take(fmt.Sprint(i), now.Add(time.Duration(i)))
+  }
+  if len(l.buckets) > maxBuckets {
+    t.Errorf("got %d buckets, want at most %d", len(l.buckets), maxBuckets)
+  }
+  if l.buckets[fmt.Sprint(3*maxBuckets-1)] == nil {
+    t.Error("the most recently used bucket was evicted")
+  }
+  if l.buckets["0"] != nil {
+    t.Error("the least recently used bucket was kept")
+  }
+}
+
+func TestRateLimiterEvictsTwice(t *testing.T) {
+  l := &rateLimiter{rps: 0.001, burst: 1, buckets: make(map[string]*bucket)}
+  now := time.Now()
+  for i := 0; i < maxBuckets; i++ {
+    l.take(fmt.Sprint(i), now.Add(time.Duration(i)))
+  }
+  for i := 0; i < 2; i++ {
+    l.take(fmt.Sprint("new", i), now.Add(time.Duration(maxBuckets+i)))
+  }
+  if l.buckets["0"] != nil || l.buckets["1"] != nil {
+    t.Error("the second eviction didn't remove the least recently used bucket")
+  }
+  if len(l.buckets) != maxBuckets || l.buckets["2"] == nil {
+    t.Errorf("got %d buckets, want %d with the third oldest kept", len(l.buckets), maxBuckets)
+  }
+}
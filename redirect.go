@@ -0,0 +1,88 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// AddRedirect registers a route that redirects requests to target with the
+// given status code, which must be a 3xx code. The target may refer to
+// submatches by index as "$1" or "${1}"; "$$" stands for a literal "$". For
+// example, AddRedirect("/old/(.*)", "/new/$1", 301) redirects /old/a/b to
+// /new/a/b. A target starting with a single slash always redirects to a path
+// on the same host, even if submatches add further slashes to its start.
+// AddRedirect returns an error if the expression cannot be compiled or the
+// code is not a redirect code.
+func (h *RegexpHandler) AddRedirect(expression, target string, code int) error {
+  if code < 300 || code > 399 {
+    return fmt.Errorf("handler: invalid redirect code %d", code)
+  }
+  local := strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//")
+  _, err := h.add(expression, func(w http.ResponseWriter, r *http.Request, m []string) {
+    location := expand(target, m)
+    if local {
+      location = localPath(location)
+    }
+    http.Redirect(w, r, location, code)
+  })
+  return err
+}
+
+// localPath collapses the slashes and backslashes a path starts with into a
+// single slash. Paths taken from requests, such as //example.com, would
+// otherwise redirect to another host when used as a Location, since browsers
+// treat them as protocol-relative URLs.
+func localPath(path string) string {
+  trimmed := strings.TrimLeft(path, "/\\")
+  if len(trimmed) == len(path) {
+    return path
+  }
+  return "/" + trimmed
+}
+
+// expand replaces references to submatches in template, see AddRedirect.
+// References to submatches that don't exist expand to "".
+func expand(template string, m []string) string {
+  var b strings.Builder
+  for {
+    i := strings.IndexByte(template, '$')
+    if i < 0 || i == len(template)-1 {
+      b.WriteString(template)
+      return b.String()
+    }
+    b.WriteString(template[:i])
+    template = template[i+1:]
+    if template[0] == '$' {
+      b.WriteByte('$')
+      template = template[1:]
+      continue
+    }
+    rest := template
+    var digits string
+    if template[0] == '{' {
+      end := strings.IndexByte(template, '}')
+      if end < 0 {
+        b.WriteByte('$')
+        continue
+      }
+      digits, template = template[1:end], template[end+1:]
+    } else {
+      end := 0
+      for end < len(template) && '0' <= template[end] && template[end] <= '9' {
+        end++
+      }
+      digits, template = template[:end], template[end:]
+    }
+    n, err := strconv.Atoi(digits)
+    if err != nil {
+      b.WriteByte('$')
+      b.WriteString(rest[:len(rest)-len(template)])
+      continue
+    }
+    if n >= 1 && n <= len(m) {
+      b.WriteString(m[n-1])
+    }
+  }
+}
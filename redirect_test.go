@@ -0,0 +1,68 @@
+package handler
+
+import (
+  "net/http"
+  "testing"
+)
+
+func TestAddRedirect(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddRedirect("/old/(.*)", "/new/$1", http.StatusMovedPermanently); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.AddRedirect("/home", "/", http.StatusFound); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.AddRedirect("/price/(\\d+)", "/cost?usd=$${1}&cents=${2}", http.StatusTemporaryRedirect); err != nil {
+    t.Fatal(err)
+  }
+  for _, test := range []struct {
+    path     string
+    code     int
+    location string
+  }{
+    {"/old/a/b", http.StatusMovedPermanently, "/new/a/b"},
+    {"/home", http.StatusFound, "/"},
+    {"/price/5", http.StatusTemporaryRedirect, "/cost?usd=${1}&cents="},
+  } {
+    rec := serve(h, "GET", test.path)
+    if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+      t.Errorf("%s: got %d %q, want %d %q", test.path, rec.Code, rec.Header().Get("Location"), test.code, test.location)
+    }
+  }
+}
+
+func TestAddRedirectInvalidCode(t *testing.T) {
+  h := NewRegexpHandler()
+  for _, code := range []int{0, http.StatusOK, http.StatusNotFound} {
+    if err := h.AddRedirect("/a", "/b", code); err == nil {
+      t.Errorf("code %d was accepted", code)
+    }
+  }
+  if h.Len() != 0 {
+    t.Errorf("got %d routes, want none", h.Len())
+  }
+}
+
+func TestAddRedirectStaysLocal(t *testing.T) {
+  h := NewRegexpHandler()
+  if err := h.AddRedirect("/go/(.*)", "/$1", http.StatusFound); err != nil {
+    t.Fatal(err)
+  }
+  for path, want := range map[string]string{
+    "/go/a":          "/a",
+    "/go//evil.com":  "/evil.com",
+    "/go/\\evil.com": "/evil.com",
+  } {
+    if location := serve(h, "GET", path).Header().Get("Location"); location != want {
+      t.Errorf("%s: got Location %q, want %q", path, location, want)
+    }
+  }
+  // Targets that aren't paths are left to the caller.
+  if err := h.AddRedirect("/out/(.*)", "https://$1", http.StatusFound); err != nil {
+    t.Fatal(err)
+  }
+  if location := serve(h, "GET", "/out/example.com").Header().Get("Location"); location != "https://example.com" {
+    t.Errorf("got Location %q, want https://example.com", location)
+  }
+}
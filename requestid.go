@@ -0,0 +1,47 @@
+package handler
+
+import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "net/http"
+)
+
+// NewRequestID generates the IDs RequestID assigns to requests without one.
+// It returns 32 random hexadecimal digits by default, and may be replaced,
+// e.g. to make IDs deterministic in tests.
+var NewRequestID = func() string {
+  b := make([]byte, 16)
+  rand.Read(b)
+  return hex.EncodeToString(b)
+}
+
+type requestIDKey struct{}
+
+// RequestID returns a middleware, for use with Use, that gives each request
+// an ID. The ID is taken from the request header with the given name, or
+// generated by NewRequestID if the header is absent, and is stored in the
+// request's context, see RequestIDFromContext, and set in the same header of
+// the response. The header name defaults to X-Request-ID.
+func RequestID(headerName string) func(http.Handler) http.Handler {
+  if headerName == "" {
+    headerName = "X-Request-ID"
+  }
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      id := r.Header.Get(headerName)
+      if id == "" {
+        id = NewRequestID()
+      }
+      w.Header().Set(headerName, id)
+      next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+    })
+  }
+}
+
+// RequestIDFromContext returns the ID RequestID gave the request, or "" if it
+// has none.
+func RequestIDFromContext(r *http.Request) string {
+  id, _ := r.Context().Value(requestIDKey{}).(string)
+  return id
+}
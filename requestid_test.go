@@ -0,0 +1,42 @@
+package handler
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "testing"
+)
+
+func TestRequestID(t *testing.T) {
+  defer func(f func() string) { NewRequestID = f }(NewRequestID)
+  NewRequestID = func() string { return "generated" }
+  h := NewRegexpHandler()
+  h.Use(RequestID(""))
+  var id string
+  h.Add("/a", func(w http.ResponseWriter, r *http.Request, m []string) {
+    id = RequestIDFromContext(r)
+  })
+  rec := serve(h, "GET", "/a")
+  if id != "generated" || rec.Header().Get("X-Request-ID") != "generated" {
+    t.Errorf("got %q in the context and %q in the response, want a generated ID", id, rec.Header().Get("X-Request-ID"))
+  }
+  r := httptest.NewRequest("GET", "/a", nil)
+  r.Header.Set("X-Request-ID", "incoming")
+  rec = httptest.NewRecorder()
+  h.ServeHTTP(rec, r)
+  if id != "incoming" || rec.Header().Get("X-Request-ID") != "incoming" {
+    t.Errorf("got %q in the context and %q in the response, want the incoming ID", id, rec.Header().Get("X-Request-ID"))
+  }
+}
+
+func TestRequestIDCustomHeader(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Use(RequestID("X-Correlation-ID"))
+  h.Add("/a", write("a"))
+  rec := serve(h, "GET", "/a")
+  if id := rec.Header().Get("X-Correlation-ID"); len(id) != 32 {
+    t.Errorf("got ID %q, want 32 hexadecimal digits", id)
+  }
+  if RequestIDFromContext(httptest.NewRequest("GET", "/", nil)) != "" {
+    t.Error("got an ID for a request RequestID didn't see")
+  }
+}
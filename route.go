@@ -0,0 +1,290 @@
+package handler
+
+import (
+  "net"
+  "net/http"
+  "regexp"
+  "regexp/syntax"
+  "strings"
+)
+
+// Route is a route registered with a RegexpHandler. Its methods configure the
+// route further and return it, so that calls can be chained:
+//
+//   h.Add("/users/(\\d+)", f).Methods("GET", "HEAD").Name("user")
+type Route struct {
+  h          *RegexpHandler
+  expression string
+  re         *regexp.Regexp
+  name       string
+  methods    []string
+  host       *regexp.Regexp
+  // hostLower is set for host expressions added with HostCaseInsensitive.
+  hostLower bool
+  // accept is the media type of routes added through AddAccept.
+  accept string
+  // conditions are further requirements a request must meet to match. They
+  // are passed the route they are checked for, which in a clone is a copy of
+  // the one they were added to.
+  conditions []func(*Route, *http.Request) bool
+  // prefix and sub are set for routes added through Mount.
+  prefix string
+  sub    *RegexpHandler
+  // verbatim is set for routes whose expression isn't compiled according to
+  // the handler's AnchorMode and CaseInsensitive, see Reanchor.
+  verbatim bool
+  // longest is set for routes matching with leftmost-longest semantics.
+  longest bool
+  // literal is set for routes added through AddLiteral.
+  literal bool
+  // group is set for routes added through a Group.
+  group *Group
+  // literals is the number of literal characters in re, see MatchSpecific.
+  literals int
+  // literalPrefix is the literal text every path matching re starts with,
+  // checked before running re.
+  literalPrefix string
+  middleware    []func(http.Handler) http.Handler
+  // recover is the route's own recover handler, see Recover.
+  recover func(http.ResponseWriter, *http.Request, interface{})
+  // hits counts the requests the route served, see TrackCoverage.
+  hits int64
+  // sampler is set for routes added through AddSampled.
+  sampler *sampler
+  // weight is set for routes added through AddWeighted.
+  weight int
+  f      func(http.ResponseWriter, *http.Request, []string)
+}
+
+// Methods restricts the route to requests whose method is one of methods.
+// Methods are compared case-insensitively, since clients and proxies may send
+// custom methods in any case and net/http doesn't normalize them. A route
+// without methods matches any method.
+func (rt *Route) Methods(methods ...string) *Route {
+  methods = upper(methods)
+  rt.h.mu.Lock()
+  rt.methods = methods
+  rt.h.mu.Unlock()
+  return rt
+}
+
+// Longest makes the route match with leftmost-longest semantics, as
+// regexp.Regexp.Longest does, instead of leftmost-first. Where expressions
+// aren't anchored at the end, this changes which alternative supplies the
+// submatches: with AnchorStart, "/(a|ab)" matches /abc with the submatch "a"
+// by default, but "ab" with Longest. Expressions that must match the entire
+// path match the same paths either way.
+func (rt *Route) Longest() *Route {
+  re := regexp.MustCompile(rt.re.String())
+  re.Longest()
+  rt.h.mu.Lock()
+  rt.re = re
+  rt.longest = true
+  rt.h.mu.Unlock()
+  return rt
+}
+
+// upper returns a copy of methods in upper case, the form they are reported
+// in by Routes and the Allow header.
+func upper(methods []string) []string {
+  if len(methods) == 0 {
+    return nil
+  }
+  u := make([]string, len(methods))
+  for i, m := range methods {
+    u[i] = strings.ToUpper(m)
+  }
+  return u
+}
+
+// Name gives the route a name, see URL.
+func (rt *Route) Name(name string) *Route {
+  rt.h.mu.Lock()
+  rt.name = name
+  rt.h.mu.Unlock()
+  return rt
+}
+
+// Use appends a middleware to the route. Unlike middleware added to the
+// handler, it only wraps requests the route serves, and runs after the
+// handler's middleware. Like the handler's middleware, it can stop dispatch by
+// not calling the next handler.
+func (rt *Route) Use(middleware func(http.Handler) http.Handler) *Route {
+  rt.h.mu.Lock()
+  rt.middleware = append(rt.middleware, middleware)
+  rt.h.mu.Unlock()
+  return rt
+}
+
+// Recover makes ServeHTTP recover from panics in the route's function, its
+// middleware included, and answer the request with handler instead of the
+// handler's RecoverHandler. It applies whether or not the handler's Recover
+// is set. As with Recover, panics with http.ErrAbortHandler are not
+// recovered.
+func (rt *Route) Recover(handler func(w http.ResponseWriter, r *http.Request, v interface{})) *Route {
+  rt.h.mu.Lock()
+  rt.recover = handler
+  rt.h.mu.Unlock()
+  return rt
+}
+
+// literals returns the number of literal characters every match of re must
+// contain.
+func literals(re *regexp.Regexp) int {
+  parsed, err := syntax.Parse(re.String(), syntax.Perl)
+  if err != nil {
+    return 0
+  }
+  return countLiterals(parsed)
+}
+
+func countLiterals(re *syntax.Regexp) int {
+  switch re.Op {
+  case syntax.OpLiteral:
+    return len(re.Rune)
+  case syntax.OpConcat, syntax.OpCapture:
+    n := 0
+    for _, sub := range re.Sub {
+      n += countLiterals(sub)
+    }
+    return n
+  case syntax.OpPlus:
+    return countLiterals(re.Sub[0])
+  case syntax.OpRepeat:
+    return re.Min * countLiterals(re.Sub[0])
+  }
+  return 0
+}
+
+// literalPrefix returns the literal text every string matching re must start
+// with, or "" if re isn't anchored at the start or starts with anything else.
+// Case-insensitive literals are not included.
+func literalPrefix(re *regexp.Regexp) string {
+  parsed, err := syntax.Parse(re.String(), syntax.Perl)
+  if err != nil {
+    return ""
+  }
+  if parsed.Op != syntax.OpConcat || len(parsed.Sub) == 0 || parsed.Sub[0].Op != syntax.OpBeginText {
+    return ""
+  }
+  var b strings.Builder
+  for _, sub := range parsed.Sub[1:] {
+    if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+      break
+    }
+    b.WriteString(string(sub.Rune))
+  }
+  return b.String()
+}
+
+// noSubmatches is the submatches of routes without groups. It is shared, since
+// it can't be modified and appending to it copies it.
+var noSubmatches = []string{}
+
+// submatches returns the submatches of path if the route's expression matches
+// it. Matching an expression without groups doesn't allocate. With groups,
+// the slice allocated by FindStringSubmatch is returned as is: the regexp
+// package can't fill a caller's buffer, so pooling slices wouldn't save that
+// allocation, and route functions may keep the slice after returning.
+func (rt *Route) submatches(path string) ([]string, bool) {
+  if rt.re.NumSubexp() == 0 {
+    return noSubmatches, rt.re.MatchString(path)
+  }
+  matches := rt.re.FindStringSubmatch(path)
+  if matches == nil {
+    return nil, false
+  }
+  return matches[1:], true
+}
+
+// matchesRequest reports whether the route accepts a request whose path
+// matches its expression, apart from the request's method.
+func (rt *Route) matchesRequest(r *http.Request) bool {
+  return rt.rejection(r) == ""
+}
+
+// rejection returns why the route doesn't accept a request whose path matches
+// its expression, apart from the request's method, or "" if it does.
+func (rt *Route) rejection(r *http.Request) string {
+  if !rt.matchesHost(r.Host) {
+    return "host does not match"
+  }
+  if rt.accept != "" && acceptQuality(r.Header.Get("Accept"), rt.accept) <= 0 {
+    return "Accept header excludes " + rt.accept
+  }
+  for _, condition := range rt.conditions {
+    if !condition(rt, r) {
+      return "request does not meet a condition"
+    }
+  }
+  if rt.sub != nil {
+    if !strings.HasPrefix(r.URL.Path, rt.prefix) {
+      return "path does not start with the mount prefix"
+    }
+    if rt.sub.NotFound == nil && !rt.sub.matches(stripPrefix(r, rt.prefix)) {
+      return "no route of the mounted handler matches"
+    }
+  }
+  return ""
+}
+
+// matchesHost reports whether the route accepts the request's host. A route
+// without a host expression accepts any host.
+func (rt *Route) matchesHost(host string) bool {
+  if rt.host == nil {
+    return true
+  }
+  host = stripPort(host)
+  if rt.hostLower {
+    host = lowerASCII(host)
+  }
+  return rt.host.MatchString(host)
+}
+
+// lowerASCII lowercases the ASCII letters of s, leaving other characters as
+// they are.
+func lowerASCII(s string) string {
+  return strings.Map(func(r rune) rune {
+    if 'A' <= r && r <= 'Z' {
+      return r + 'a' - 'A'
+    }
+    return r
+  }, s)
+}
+
+// stripPort removes the port, if any, from a host of the form "host:port".
+func stripPort(host string) string {
+  if h, _, err := net.SplitHostPort(host); err == nil {
+    return h
+  }
+  return host
+}
+
+// matchesMethod reports whether the route accepts the request's method. A
+// route without methods accepts any method.
+func (rt *Route) matchesMethod(method string) bool {
+  if len(rt.methods) == 0 {
+    return true
+  }
+  for _, m := range rt.methods {
+    if strings.EqualFold(m, method) {
+      return true
+    }
+  }
+  return false
+}
+
+// serve calls the route's function, wrapped in its middleware.
+func (rt *Route) serve(w http.ResponseWriter, r *http.Request, m []string, middleware []func(http.Handler) http.Handler) {
+  if len(middleware) == 0 {
+    rt.f(w, r, m)
+    return
+  }
+  var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    rt.f(w, r, m)
+  })
+  for i := len(middleware) - 1; i >= 0; i-- {
+    handler = middleware[i](handler)
+  }
+  handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+)
+
+func TestRouteFluent(t *testing.T) {
+  h := NewRegexpHandler()
+  var log []string
+  h.Add("/users/(\\d+)", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, fmt.Sprint("user", m))
+  }).Methods("GET", "post").Name("user").Use(record(&log, "mw"))
+  h.Add("/other", func(w http.ResponseWriter, r *http.Request, m []string) {
+    log = append(log, "other")
+  })
+  serve(h, "POST", "/users/1")
+  serve(h, "DELETE", "/users/1")
+  serve(h, "GET", "/other")
+  if got := fmt.Sprint(log); got != "[mw[1] user[1] other]" {
+    t.Errorf("got %s, want the middleware to wrap only the user route", got)
+  }
+  if path, err := h.URL("user", "7"); err != nil || path != "/users/7" {
+    t.Errorf("URL(\"user\") = %q, %v", path, err)
+  }
+}
+
+func TestRouteMethodsEmptyMatchesAll(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Add("/a", write("a")).Methods()
+  if body := serve(h, "PATCH", "/a").Body.String(); body != "a" {
+    t.Errorf("got %q, want a route without methods to match any method", body)
+  }
+}
+
+func TestRouteLongest(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AnchorMode = AnchorStart
+  var got []string
+  f := func(w http.ResponseWriter, r *http.Request, m []string) {
+    got = m
+  }
+  h.Add("/first/(a|ab)", f)
+  h.Add("/longest/(a|ab)", f).Longest()
+  serve(h, "GET", "/first/abc")
+  if fmt.Sprint(got) != "[a]" {
+    t.Errorf("leftmost-first: got %q, want [a]", got)
+  }
+  serve(h, "GET", "/longest/abc")
+  if fmt.Sprint(got) != "[ab]" {
+    t.Errorf("leftmost-longest: got %q, want [ab]", got)
+  }
+  if err := h.Compile(); err != nil {
+    t.Fatal(err)
+  }
+  got = nil
+  serve(h, "GET", "/longest/abc")
+  if fmt.Sprint(got) != "[ab]" {
+    t.Errorf("compiled: got %q, want [ab]", got)
+  }
+}
+
+func TestSubmatchesMatchFindStringSubmatch(t *testing.T) {
+  h := NewRegexpHandler()
+  for _, expression := range []string{"/a", "/users/(\\d+)", "/(a|ab)(c?)", "/opt(/x)?(/y)?", "/f/(?P<name>.*)\\.(\\w+)"} {
+    rt, err := h.newRoute(expression, nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    for _, path := range []string{"/a", "/users/42", "/abc", "/ac", "/opt", "/opt/y", "/f/a.b.c", "/none"} {
+      got, ok := rt.submatches(path)
+      want := rt.re.FindStringSubmatch(path)
+      if ok != (want != nil) || ok && fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want[1:]) {
+        t.Errorf("%s on %s: got %q %v, want %q", expression, path, got, ok, want)
+      }
+    }
+  }
+}
+
+func TestSubmatchesAllocs(t *testing.T) {
+  h := NewRegexpHandler()
+  for expression, want := range map[string]float64{"/users/new": 0, "/users/(\\d+)": 1} {
+    rt, err := h.newRoute(expression, nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    path := "/users/42"
+    if expression == "/users/new" {
+      path = "/users/new"
+    }
+    if allocs := testing.AllocsPerRun(100, func() { rt.submatches(path) }); allocs > want {
+      t.Errorf("%s: got %v allocations, want at most %v", expression, allocs, want)
+    }
+  }
+}
+
+// benchmarkSubmatches measures matching a path against a route with the given
+// expression, through submatches or, as before it, FindStringSubmatch.
+func benchmarkSubmatches(b *testing.B, expression, path string, direct bool) {
+  rt, err := NewRegexpHandler().newRoute(expression, nil)
+  if err != nil {
+    b.Fatal(err)
+  }
+  b.ReportAllocs()
+  for i := 0; i < b.N; i++ {
+    if direct {
+      rt.re.FindStringSubmatch(path)
+    } else {
+      rt.submatches(path)
+    }
+  }
+}
+
+func BenchmarkSubmatchesNoGroups(b *testing.B) {
+  benchmarkSubmatches(b, "/users/new", "/users/new", false)
+}
+
+func BenchmarkFindStringSubmatchNoGroups(b *testing.B) {
+  benchmarkSubmatches(b, "/users/new", "/users/new", true)
+}
+
+func BenchmarkSubmatchesGroups(b *testing.B) {
+  benchmarkSubmatches(b, "/users/(\\d+)/(\\w+)", "/users/42/posts", false)
+}
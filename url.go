@@ -0,0 +1,100 @@
+package handler
+
+import (
+  "fmt"
+  "net/http"
+  "regexp"
+  "regexp/syntax"
+  "strings"
+)
+
+// AddName is like Add, but also gives the route a name so that URLs matching
+// it can be built with URL.
+func (h *RegexpHandler) AddName(name, expression string, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  return h.Add(expression, function).Name(name)
+}
+
+// URL builds a path that matches the route with the given name by
+// substituting args, in order, for the groups of its expression. The args are
+// substituted as they are, without escaping.
+//
+// Only expressions made up of literal text and groups can be reversed, e.g.
+// "/users/(\\d+)/posts/(\\d+)". URL returns an error if the expression can't be
+// reversed, if the number of args doesn't match the number of groups, or if
+// the resulting path doesn't match the route's expression.
+func (h *RegexpHandler) URL(name string, args ...string) (string, error) {
+  rt := h.named(name)
+  if rt == nil {
+    return "", fmt.Errorf("handler: no route named %q", name)
+  }
+  re, err := syntax.Parse(rt.expression, syntax.Perl)
+  if err != nil {
+    return "", err
+  }
+  literals := []string{""}
+  if !reverse(re, &literals) {
+    return "", fmt.Errorf("handler: expression %q of route %q cannot be reversed", rt.expression, name)
+  }
+  if len(args) != len(literals)-1 {
+    return "", fmt.Errorf("handler: route %q takes %d arguments, got %d", name, len(literals)-1, len(args))
+  }
+  var b strings.Builder
+  for i, arg := range args {
+    b.WriteString(literals[i])
+    b.WriteString(arg)
+  }
+  b.WriteString(literals[len(literals)-1])
+  path := b.String()
+  if !rt.re.MatchString(path) {
+    return "", fmt.Errorf("handler: %q does not match route %q", path, name)
+  }
+  return path, nil
+}
+
+// RegexpFor returns the compiled, anchored expression of the route with the
+// given name. It reports false if there is no such route.
+func (h *RegexpHandler) RegexpFor(name string) (*regexp.Regexp, bool) {
+  rt := h.named(name)
+  if rt == nil {
+    return nil, false
+  }
+  return rt.re, true
+}
+
+// named returns the first route with the given name, or nil.
+func (h *RegexpHandler) named(name string) *Route {
+  h.mu.RLock()
+  defer h.mu.RUnlock()
+  for _, rt := range h.routes {
+    if rt.name == name {
+      return rt
+    }
+  }
+  return nil
+}
+
+// reverse splits a parsed expression into the literal text between its
+// top-level groups, appending to literals. It reports false if the expression
+// contains anything other than literal text, groups and anchors.
+func reverse(re *syntax.Regexp, literals *[]string) bool {
+  switch re.Op {
+  case syntax.OpLiteral:
+    (*literals)[len(*literals)-1] += string(re.Rune)
+  case syntax.OpConcat:
+    for _, sub := range re.Sub {
+      if !reverse(sub, literals) {
+        return false
+      }
+    }
+  case syntax.OpCapture:
+    // Nested groups would need arguments of their own.
+    if re.Sub[0].MaxCap() > 0 {
+      return false
+    }
+    *literals = append(*literals, "")
+  case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpEmptyMatch:
+  default:
+    return false
+  }
+  return true
+}
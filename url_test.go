@@ -0,0 +1,52 @@
+package handler
+
+import "testing"
+
+func TestURL(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddName("post", "/users/(\\d+)/posts/(\\d+)", write("post"))
+  path, err := h.URL("post", "42", "7")
+  if err != nil || path != "/users/42/posts/7" {
+    t.Errorf("got %q, %v; want /users/42/posts/7", path, err)
+  }
+  if body := serve(h, "GET", path).Body.String(); body != "post" {
+    t.Errorf("built path %q does not reach the route", path)
+  }
+}
+
+func TestURLErrors(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddName("post", "/users/(\\d+)/posts/(\\d+)", write("post"))
+  h.AddName("any", "/a+/(\\d+)", write("any"))
+  for _, tt := range []struct {
+    name string
+    args []string
+  }{
+    {"post", []string{"42"}},
+    {"post", []string{"42", "7", "1"}},
+    {"post", []string{"x", "7"}},
+    {"missing", nil},
+    {"any", []string{"1"}},
+  } {
+    if path, err := h.URL(tt.name, tt.args...); err == nil {
+      t.Errorf("URL(%q, %q) = %q, want an error", tt.name, tt.args, path)
+    }
+  }
+}
+
+func TestRegexpFor(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AddName("user", "/users/(\\d+)", write("user"))
+  re, ok := h.RegexpFor("user")
+  if !ok {
+    t.Fatal("RegexpFor(\"user\") found no route")
+  }
+  for path, want := range map[string]bool{"/users/42": true, "/users/x": false, "/users/42/posts": false, "/a/users/42": false} {
+    if got := re.MatchString(path); got != want {
+      t.Errorf("MatchString(%q) = %v, want %v", path, got, want)
+    }
+  }
+  if _, ok := h.RegexpFor("missing"); ok {
+    t.Error("RegexpFor(\"missing\") found a route")
+  }
+}
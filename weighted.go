@@ -0,0 +1,71 @@
+package handler
+
+import (
+  "fmt"
+  "math/rand"
+  "net/http"
+  "sync"
+)
+
+// randMu serializes calls to the Rand of handlers, which may be shared by
+// clones.
+var randMu sync.Mutex
+
+// AddWeighted is like Add, but requests are split between the routes added
+// through AddWeighted with the same expression, e.g. for canary releases:
+// when one of them matches a request, one of those that accept it is chosen
+// at random with a probability proportional to its weight. Other routes are
+// never chosen from; the weighted routes are only considered where the first
+// of them would be in registration order. Choices are made with Rand, if
+// set. AddWeighted panics if weight is not positive.
+func (h *RegexpHandler) AddWeighted(expression string, weight int, function func(http.ResponseWriter, *http.Request, []string)) *Route {
+  if weight <= 0 {
+    panic(fmt.Errorf("handler: invalid route weight %d", weight))
+  }
+  rt, err := h.newRoute(expression, function)
+  if err != nil {
+    panic(err)
+  }
+  rt.weight = weight
+  return h.addRoute(rt)
+}
+
+// chooseWeighted replaces the weighted route of a match with one chosen at
+// random among the weighted routes with the same expression that accept the
+// request.
+func (h *RegexpHandler) chooseWeighted(routes []*Route, r *http.Request, m *match, method string) {
+  if m.head {
+    method = http.MethodGet
+  }
+  var candidates []*Route
+  total := 0
+  for _, rt := range routes {
+    if rt.weight > 0 && rt.expression == m.route.expression && rt.matchesRequest(r) && rt.matchesMethod(method) {
+      candidates = append(candidates, rt)
+      total += rt.weight
+    }
+  }
+  if len(candidates) < 2 {
+    return
+  }
+  n := h.intn(total)
+  for _, rt := range candidates {
+    if n -= rt.weight; n < 0 {
+      if submatches, ok := rt.submatches(m.path); ok && rt != m.route {
+        m.route, m.submatches = rt, submatches
+      }
+      return
+    }
+  }
+}
+
+// intn returns a random number in [0, n) from Rand, or from math/rand if Rand
+// is nil.
+func (h *RegexpHandler) intn(n int) int {
+  if h.Rand == nil {
+    return rand.Intn(n)
+  }
+  randMu.Lock()
+  defer randMu.Unlock()
+  return h.Rand.Intn(n)
+}
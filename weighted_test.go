@@ -0,0 +1,74 @@
+package handler
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+func TestAddWeighted(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RejectDuplicates = true
+  h.Rand = rand.New(rand.NewSource(1))
+  h.AddWeighted("/checkout", 80, write("stable"))
+  h.AddWeighted("/checkout", 20, write("canary"))
+  counts := map[string]int{}
+  const n = 10000
+  for i := 0; i < n; i++ {
+    counts[serve(h, "GET", "/checkout").Body.String()]++
+  }
+  if counts["stable"]+counts["canary"] != n {
+    t.Fatalf("got %v, want every request served by a weighted route", counts)
+  }
+  if canary := float64(counts["canary"]) / n; canary < 0.18 || canary > 0.22 {
+    t.Errorf("got %.3f of requests for the canary, want about 0.2", canary)
+  }
+}
+
+func TestAddWeightedDeterministic(t *testing.T) {
+  run := func() []string {
+    h := NewRegexpHandler()
+    h.Rand = rand.New(rand.NewSource(42))
+    h.AddWeighted("/a", 1, write("x"))
+    h.AddWeighted("/a", 1, write("y"))
+    var bodies []string
+    for i := 0; i < 20; i++ {
+      bodies = append(bodies, serve(h, "GET", "/a").Body.String())
+    }
+    return bodies
+  }
+  if a, b := run(), run(); fmt.Sprint(a) != fmt.Sprint(b) {
+    t.Errorf("got %v and %v with the same seed", a, b)
+  }
+}
+
+func TestAddWeightedDuplicates(t *testing.T) {
+  h := NewRegexpHandler()
+  h.RejectDuplicates = true
+  h.AddWeighted("/a", 1, write("a"))
+  for name, add := range map[string]func(){
+    "unweighted after weighted": func() { h.Add("/a", write("b")) },
+    "weighted after unweighted": func() {
+      h.Add("/b", write("b"))
+      h.AddWeighted("/b", 1, write("b"))
+    },
+  } {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Errorf("%s: got no panic", name)
+        }
+      }()
+      add()
+    }()
+  }
+}
+
+func TestAddWeightedInvalid(t *testing.T) {
+  defer func() {
+    if recover() == nil {
+      t.Error("AddWeighted didn't panic for a zero weight")
+    }
+  }()
+  NewRegexpHandler().AddWeighted("/a", 0, write("a"))
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+  "bufio"
+  "errors"
+  "io"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// responseWriter wraps an http.ResponseWriter to record the status code and
+// body size of the response. It implements http.Flusher, http.Hijacker and
+// http.Pusher by delegating to the wrapped writer, so that wrapping doesn't
+// break streaming or connection upgrades.
+type responseWriter struct {
+  http.ResponseWriter
+  status   int
+  bytes    int64
+  hijacked bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+  if w.status == 0 {
+    w.status = status
+  }
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  n, err := w.ResponseWriter.Write(b)
+  w.bytes += int64(n)
+  return n, err
+}
+
+// ReadFrom copies src to the response, using the wrapped writer's ReadFrom if
+// it implements io.ReaderFrom, so that io.Copy can still use sendfile.
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  var n int64
+  var err error
+  if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+    n, err = rf.ReadFrom(src)
+  } else {
+    n, err = io.Copy(w.ResponseWriter, src)
+  }
+  w.bytes += n
+  return n, err
+}
+
+// Status returns the status code of the response, or 200 if nothing has been
+// written yet, since that's what net/http will send.
+func (w *responseWriter) Status() int {
+  if w.status == 0 {
+    return http.StatusOK
+  }
+  return w.status
+}
+
+// written reports whether the response's header has been written or the
+// connection hijacked.
+func (w *responseWriter) written() bool {
+  return w.status != 0 || w.hijacked
+}
+
+// Flush sends any buffered data to the client. It does nothing if the wrapped
+// writer isn't an http.Flusher.
+func (w *responseWriter) Flush() {
+  if w.status == 0 {
+    w.status = http.StatusOK
+  }
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// Hijack takes over the connection if the wrapped writer is an http.Hijacker.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  h, ok := w.ResponseWriter.(http.Hijacker)
+  if !ok {
+    return nil, nil, errors.New("handler: response writer does not implement http.Hijacker")
+  }
+  conn, rw, err := h.Hijack()
+  if err == nil {
+    w.hijacked = true
+  }
+  return conn, rw, err
+}
+
+// Push initiates an HTTP/2 server push if the wrapped writer is an
+// http.Pusher, and returns http.ErrNotSupported otherwise.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+  if p, ok := w.ResponseWriter.(http.Pusher); ok {
+    return p.Push(target, opts)
+  }
+  return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
+
+// timingWriter wraps an http.ResponseWriter to add a Server-Timing header
+// with the time elapsed since start when the response's header is written.
+type timingWriter struct {
+  responseWriter
+  start time.Time
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+  w.setTiming()
+  w.responseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+  w.setTiming()
+  return w.responseWriter.Write(b)
+}
+
+func (w *timingWriter) ReadFrom(src io.Reader) (int64, error) {
+  w.setTiming()
+  return w.responseWriter.ReadFrom(src)
+}
+
+func (w *timingWriter) Flush() {
+  w.setTiming()
+  w.responseWriter.Flush()
+}
+
+// setTiming adds the Server-Timing header unless the header has already been
+// written.
+func (w *timingWriter) setTiming() {
+  if w.written() {
+    return
+  }
+  dur := float64(time.Since(w.start)) / float64(time.Millisecond)
+  w.Header().Add("Server-Timing", "app;dur="+strconv.FormatFloat(dur, 'f', 1, 64))
+}
+
+// headWriter wraps an http.ResponseWriter to discard the body of a response
+// to a HEAD request.
+type headWriter struct {
+  http.ResponseWriter
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+  return len(b), nil
+}
+
+// Flush sends the response's header to the client. It does nothing if the
+// wrapped writer isn't an http.Flusher.
+func (w *headWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (w *headWriter) Unwrap() http.ResponseWriter {
+  return w.ResponseWriter
+}
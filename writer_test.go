@@ -0,0 +1,176 @@
+package handler
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// hijackRecorder is an httptest.ResponseRecorder that also implements
+// http.Hijacker and http.Pusher.
+type hijackRecorder struct {
+  *httptest.ResponseRecorder
+  hijacked bool
+  pushed   []string
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+  w.hijacked = true
+  return nil, nil, nil
+}
+
+func (w *hijackRecorder) Push(target string, opts *http.PushOptions) error {
+  w.pushed = append(w.pushed, target)
+  return nil
+}
+
+func TestResponseWriterForwards(t *testing.T) {
+  h := NewRegexpHandler()
+  h.Observe = func(pattern string, status int, duration time.Duration) {}
+  h.Add("/ws", func(w http.ResponseWriter, r *http.Request, m []string) {
+    if _, ok := w.(*hijackRecorder); ok {
+      t.Error("the route got the unwrapped writer")
+    }
+    if err := w.(http.Pusher).Push("/app.js", nil); err != nil {
+      t.Errorf("Push: %v", err)
+    }
+    w.(http.Flusher).Flush()
+    if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+      t.Errorf("Hijack: %v", err)
+    }
+  })
+  w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+  h.ServeHTTP(w, httptest.NewRequest("GET", "/ws", nil))
+  if !w.hijacked || len(w.pushed) != 1 || !w.Flushed {
+    t.Errorf("got hijacked %v, pushed %v, flushed %v; want the wrapper to forward all three", w.hijacked, w.pushed, w.Flushed)
+  }
+}
+
+func TestResponseWriterHijackUnsupported(t *testing.T) {
+  h := NewRegexpHandler()
+  var err error
+  h.Add("/ws", func(w http.ResponseWriter, r *http.Request, m []string) {
+    _, _, err = w.(http.Hijacker).Hijack()
+  })
+  h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ws", nil))
+  if err == nil {
+    t.Error("Hijack succeeded on a writer that doesn't implement http.Hijacker")
+  }
+}
+
+// flushRecorder records what had been written at each call to Flush.
+type flushRecorder struct {
+  *httptest.ResponseRecorder
+  flushes []string
+}
+
+func (w *flushRecorder) Flush() {
+  w.flushes = append(w.flushes, w.Body.String())
+}
+
+// plainWriter implements http.ResponseWriter and nothing else.
+type plainWriter struct {
+  http.ResponseWriter
+}
+
+func TestFlushStreams(t *testing.T) {
+  h := NewRegexpHandler()
+  h.AutoHEAD = true
+  h.ServerTiming = true
+  h.Observe = func(pattern string, status int, duration time.Duration) {}
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      next.ServeHTTP(w, r)
+    })
+  })
+  h.AddMethod("GET", "/events", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.Header().Set("Content-Type", "text/event-stream")
+    for _, event := range []string{"a", "b"} {
+      w.Write([]byte("data: " + event + "\n\n"))
+      w.(http.Flusher).Flush()
+    }
+  })
+  for _, test := range []struct {
+    method string
+    want   string
+  }{
+    {"GET", `["data: a\n\n" "data: a\n\ndata: b\n\n"]`},
+    {"HEAD", `["" ""]`},
+  } {
+    w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+    h.ServeHTTP(w, httptest.NewRequest(test.method, "/events", nil))
+    if got := fmt.Sprintf("%q", w.flushes); got != test.want {
+      t.Errorf("%s: got flushes %s, want %s", test.method, got, test.want)
+    }
+  }
+  rec := httptest.NewRecorder()
+  h.ServeHTTP(plainWriter{rec}, httptest.NewRequest("GET", "/events", nil))
+  if rec.Body.String() != "data: a\n\ndata: b\n\n" {
+    t.Errorf("got %q from a writer that isn't an http.Flusher", rec.Body.String())
+  }
+}
+
+// statusRecorder is a response writer wrapper, as WrapResponseWriter may
+// return, that sets a header and records the status it sees.
+type statusRecorder struct {
+  http.ResponseWriter
+  status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+  w.status = status
+  w.Header().Set("X-Wrapped", "yes")
+  w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+  if w.status == 0 {
+    w.WriteHeader(http.StatusOK)
+  }
+  return w.ResponseWriter.Write(b)
+}
+
+func TestWrapResponseWriter(t *testing.T) {
+  h := NewRegexpHandler()
+  var wrapped *statusRecorder
+  h.WrapResponseWriter = func(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+    wrapped = &statusRecorder{ResponseWriter: w}
+    return wrapped
+  }
+  var observed int
+  h.Observe = func(pattern string, status int, duration time.Duration) {
+    observed = status
+  }
+  var written int64
+  h.Use(func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      next.ServeHTTP(w, r)
+      written, _ = BytesWritten(r)
+    })
+  })
+  h.Add("/created", func(w http.ResponseWriter, r *http.Request, m []string) {
+    w.WriteHeader(http.StatusCreated)
+    w.Write([]byte("hello"))
+  })
+  h.WriteNotFound = true
+  for _, test := range []struct {
+    path   string
+    status int
+  }{{"/created", http.StatusCreated}, {"/missing", http.StatusNotFound}} {
+    rec := serve(h, "GET", test.path)
+    if rec.Code != test.status || rec.Header().Get("X-Wrapped") != "yes" {
+      t.Errorf("%s: got %d with X-Wrapped %q, want %d through the wrapper", test.path, rec.Code, rec.Header().Get("X-Wrapped"), test.status)
+    }
+    if wrapped.status != test.status || observed != test.status {
+      t.Errorf("%s: the wrapper saw %d and Observe %d, want %d", test.path, wrapped.status, observed, test.status)
+    }
+  }
+  serve(h, "GET", "/created")
+  if written != 5 {
+    t.Errorf("got %d bytes written, want 5", written)
+  }
+}